@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	anomalySearchSpike  = "search_spike"
+	anomalyUnusualTime  = "unusual_time"
+	anomalySensitiveTag = "sensitive_tag"
+	anomalyBulkPaging   = "bulk_paging"
+
+	// Baseline of hourly search volume is exponentially weighted moving
+	// average and it's used after anomalyMinBuckets hours are observed.
+	anomalyAlpha       = 0.05
+	anomalyMinBuckets  = 24
+	anomalyMaxGap      = 24 * 7
+	anomalyMinSpike    = 10
+	anomalyMinSearches = 50
+	anomalyRareHour    = 0.01
+	anomalyPagingTTL   = 10 * time.Minute
+	anomalyQueueSize   = 4096
+)
+
+type anomalyConfig struct {
+	// SpikeFactor is number of standard deviations above the mean of hourly
+	// search volume to raise an alert.
+	SpikeFactor float64
+
+	// SensitiveTags are patterns of path.Match. Access to a matched tag
+	// raises an alert at the first time for each user.
+	SensitiveTags []string
+
+	// BulkPages is number of result pages fetched for a search within
+	// anomalyPagingTTL to raise an alert. 0 disables the check.
+	BulkPages int
+}
+
+type anomalyAlert struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	User      string    `json:"user"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+	SearchID  string    `json:"search_id,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+// anomalyAlertSink is a destination of anomaly alerts.
+type anomalyAlertSink interface {
+	send(alert *anomalyAlert) error
+}
+
+type loggerAlertSink struct{}
+
+func (x *loggerAlertSink) send(alert *anomalyAlert) error {
+	logger.WithFields(logrus.Fields{
+		"kind":       alert.Kind,
+		"user":       alert.User,
+		"request_id": alert.RequestID,
+		"search_id":  alert.SearchID,
+		"tags":       alert.Tags,
+	}).Warn("Anomaly detected: " + alert.Message)
+	return nil
+}
+
+type webhookAlertSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newWebhookAlertSink(endpoint string) *webhookAlertSink {
+	return &webhookAlertSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (x *webhookAlertSink) send(alert *anomalyAlert) error {
+	raw, err := json.Marshal(alert)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal anomaly alert")
+	}
+
+	resp, err := x.client.Post(x.endpoint, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrapf(err, "Fail to send anomaly alert: %s", x.endpoint)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Anomaly webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// searchVolume keeps search count of the current hour and moving average and
+// variance of the past hours. Hours without search are counted as zero.
+type searchVolume struct {
+	bucket   time.Time
+	count    float64
+	mean     float64
+	variance float64
+	buckets  int
+	alerted  bool
+}
+
+func (x *searchVolume) update(count float64) {
+	diff := count - x.mean
+	incr := anomalyAlpha * diff
+	x.mean += incr
+	x.variance = (1 - anomalyAlpha) * (x.variance + diff*incr)
+	x.buckets++
+}
+
+func (x *searchVolume) add(ts time.Time) {
+	hour := ts.Truncate(time.Hour)
+	if x.bucket.IsZero() {
+		x.bucket = hour
+	}
+
+	if hour.After(x.bucket) {
+		x.update(x.count)
+		gap := int(hour.Sub(x.bucket)/time.Hour) - 1
+		if gap > anomalyMaxGap {
+			gap = anomalyMaxGap
+		}
+		for i := 0; i < gap; i++ {
+			x.update(0)
+		}
+
+		x.bucket = hour
+		x.count = 0
+		x.alerted = false
+	}
+
+	x.count++
+}
+
+// spike returns true once per hour when the current count exceeds the
+// baseline.
+func (x *searchVolume) spike(factor float64) bool {
+	if x.alerted || x.buckets < anomalyMinBuckets || x.count < anomalyMinSpike {
+		return false
+	}
+
+	if x.count <= x.mean+factor*math.Sqrt(x.variance) {
+		return false
+	}
+
+	x.alerted = true
+	return true
+}
+
+type resultPaging struct {
+	first   time.Time
+	pages   int
+	rows    int
+	alerted bool
+}
+
+type userProfile struct {
+	volume   searchVolume
+	hours    [24]int
+	searches int
+	tags     map[string]bool
+	paging   map[string]*resultPaging
+}
+
+// anomalyDetector learns search activity of each user from audit events and
+// raises alerts on unusual activity. Events are processed in background by
+// run() and learn() can be used to build baseline from past events without
+// alerts.
+type anomalyDetector struct {
+	config   anomalyConfig
+	sinks    []anomalyAlertSink
+	profiles map[string]*userProfile
+	queue    chan *auditEvent
+	alerting bool
+}
+
+func newAnomalyDetector(config anomalyConfig, sinks ...anomalyAlertSink) *anomalyDetector {
+	return &anomalyDetector{
+		config:   config,
+		sinks:    sinks,
+		profiles: map[string]*userProfile{},
+		queue:    make(chan *auditEvent, anomalyQueueSize),
+	}
+}
+
+// observe implements auditObserver.
+func (x *anomalyDetector) observe(ev *auditEvent) {
+	select {
+	case x.queue <- ev:
+	default:
+		logger.WithField("seq", ev.Seq).Warn("Anomaly detector queue is full, event is dropped")
+	}
+}
+
+// learn builds baseline from audit log files without alerts. It must be
+// called before run().
+func (x *anomalyDetector) learn(files []string) error {
+	n := 0
+	err := scanAuditFiles(files, func(ev *auditEvent) bool {
+		x.process(ev)
+		n++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"events": n,
+		"users":  len(x.profiles),
+	}).Info("Learned search activity from audit log")
+	return nil
+}
+
+func (x *anomalyDetector) run() {
+	x.alerting = true
+	for ev := range x.queue {
+		x.process(ev)
+	}
+}
+
+func (x *anomalyDetector) profile(userID string) *userProfile {
+	p, ok := x.profiles[userID]
+	if !ok {
+		p = &userProfile{
+			tags:   map[string]bool{},
+			paging: map[string]*resultPaging{},
+		}
+		x.profiles[userID] = p
+	}
+	return p
+}
+
+func (x *anomalyDetector) process(ev *auditEvent) {
+	if ev.User == "" || ev.Search == nil || ev.Result == nil || ev.Result.Status >= 300 {
+		return
+	}
+
+	p := x.profile(ev.User)
+	switch ev.Type {
+	case auditSearchCreate:
+		x.checkVolume(p, ev)
+	case auditSearchFetch:
+		x.checkTags(p, ev)
+		if strings.HasSuffix(ev.Path, "/logs") {
+			x.checkPaging(p, ev)
+		}
+	}
+}
+
+func (x *anomalyDetector) checkVolume(p *userProfile, ev *auditEvent) {
+	p.volume.add(ev.Time)
+	if p.volume.spike(x.config.SpikeFactor) {
+		x.alert(ev, anomalySearchSpike, fmt.Sprintf("%d searches in this hour, baseline %.1f/hour",
+			int(p.volume.count), p.volume.mean), nil)
+	}
+
+	hour := ev.Time.UTC().Hour()
+	if p.searches >= anomalyMinSearches && float64(p.hours[hour])/float64(p.searches) < anomalyRareHour {
+		x.alert(ev, anomalyUnusualTime, fmt.Sprintf("Search at unusual hour %02d:00 UTC", hour), nil)
+	}
+	p.hours[hour]++
+	p.searches++
+}
+
+func (x *anomalyDetector) sensitive(tag string) bool {
+	for _, pattern := range x.config.SensitiveTags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTags raises an alert when the user gets logs of a sensitive tag for
+// the first time. Tags specified by the query and tags of returned logs are
+// both counted.
+func (x *anomalyDetector) checkTags(p *userProfile, ev *auditEvent) {
+	tags := append(ev.Search.searchTags(), ev.Result.Tags...)
+
+	var found []string
+	for _, tag := range tags {
+		if tag == "" || p.tags[tag] {
+			continue
+		}
+		p.tags[tag] = true
+		if x.sensitive(tag) {
+			found = append(found, tag)
+		}
+	}
+
+	if len(found) > 0 {
+		sort.Strings(found)
+		x.alert(ev, anomalySensitiveTag, "First access to sensitive tag(s): "+strings.Join(found, ", "), found)
+	}
+}
+
+// checkPaging raises an alert when many pages of a search result are fetched
+// in a short time, e.g. scraping all logs.
+func (x *anomalyDetector) checkPaging(p *userProfile, ev *auditEvent) {
+	for id, paging := range p.paging {
+		if ev.Time.Sub(paging.first) > anomalyPagingTTL {
+			delete(p.paging, id)
+		}
+	}
+
+	if x.config.BulkPages <= 0 {
+		return
+	}
+
+	paging, ok := p.paging[ev.Search.SearchID]
+	if !ok {
+		paging = &resultPaging{first: ev.Time}
+		p.paging[ev.Search.SearchID] = paging
+	}
+	paging.pages++
+	if ev.Result.Rows != nil {
+		paging.rows += *ev.Result.Rows
+	}
+
+	if !paging.alerted && paging.pages >= x.config.BulkPages {
+		paging.alerted = true
+		x.alert(ev, anomalyBulkPaging, fmt.Sprintf("%d pages (%d rows) of a search result fetched in %s",
+			paging.pages, paging.rows, ev.Time.Sub(paging.first).Round(time.Second)), nil)
+	}
+}
+
+func (x *anomalyDetector) alert(ev *auditEvent, kind, msg string, tags []string) {
+	if !x.alerting {
+		return
+	}
+
+	alert := &anomalyAlert{
+		Time:      ev.Time,
+		Kind:      kind,
+		User:      ev.User,
+		Message:   msg,
+		RequestID: ev.RequestID,
+		SearchID:  ev.Search.SearchID,
+		Tags:      tags,
+	}
+
+	for _, sink := range x.sinks {
+		if err := sink.send(alert); err != nil {
+			logger.WithError(err).WithField("alert", alert).Error("Fail to send anomaly alert")
+		}
+	}
+}
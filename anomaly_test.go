@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+)
+
+func searchEvent(user string, ts time.Time) *main.AuditEvent {
+	return &main.AuditEvent{
+		Type:   "search.create",
+		Time:   ts,
+		User:   user,
+		Path:   "/api/v1/search",
+		Search: &main.AuditSearch{SearchID: "s1"},
+		Result: &main.AuditResult{Status: 200},
+	}
+}
+
+func fetchEvent(user, searchID string, ts time.Time, tags ...string) *main.AuditEvent {
+	rows := 100
+	return &main.AuditEvent{
+		Type:   "search.fetch",
+		Time:   ts,
+		User:   user,
+		Path:   "/api/v1/search/" + searchID + "/logs",
+		Search: &main.AuditSearch{SearchID: searchID},
+		Result: &main.AuditResult{Status: 200, Rows: &rows, Tags: tags},
+	}
+}
+
+// baseline returns 2 searches per day at 10:00 and 11:00 UTC for 30 days.
+func baseline(user string, end time.Time) []*main.AuditEvent {
+	var events []*main.AuditEvent
+	for d := 30; d > 0; d-- {
+		day := end.Add(-time.Duration(d) * 24 * time.Hour).Truncate(24 * time.Hour)
+		events = append(events,
+			searchEvent(user, day.Add(10*time.Hour)),
+			searchEvent(user, day.Add(11*time.Hour)))
+	}
+	return events
+}
+
+func TestAnomalySearchSpike(t *testing.T) {
+	config := main.AnomalyConfig{SpikeFactor: 3}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	past := baseline("blue@example.com", now)
+
+	var events []*main.AuditEvent
+	for i := 0; i < 30; i++ {
+		events = append(events, searchEvent("blue@example.com", now.Add(time.Duration(i)*time.Second)))
+	}
+
+	// Alert once in the hour
+	assert.Equal(t, []string{"search_spike"}, main.DetectAnomalies(config, past, events))
+	// Normal volume
+	assert.Empty(t, main.DetectAnomalies(config, past, events[:2]))
+}
+
+func TestAnomalyUnusualTime(t *testing.T) {
+	config := main.AnomalyConfig{SpikeFactor: 3}
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	past := baseline("blue@example.com", now)
+
+	assert.Equal(t, []string{"unusual_time"}, main.DetectAnomalies(config, past, []*main.AuditEvent{
+		searchEvent("blue@example.com", now.Add(3*time.Hour)),
+	}))
+	assert.Empty(t, main.DetectAnomalies(config, past, []*main.AuditEvent{
+		searchEvent("blue@example.com", now.Add(10*time.Hour)),
+	}))
+}
+
+func TestAnomalySensitiveTag(t *testing.T) {
+	config := main.AnomalyConfig{SensitiveTags: []string{"hr.*"}}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	past := []*main.AuditEvent{fetchEvent("blue@example.com", "s0", now.Add(-time.Hour), "hr.payroll")}
+
+	kinds := main.DetectAnomalies(config, past, []*main.AuditEvent{
+		fetchEvent("blue@example.com", "s1", now, "web.access", "hr.payroll"),
+		fetchEvent("orange@example.com", "s2", now, "hr.payroll"),
+		fetchEvent("orange@example.com", "s3", now, "hr.payroll"),
+	})
+	// blue has accessed hr.payroll before and orange is alerted only once
+	assert.Equal(t, []string{"sensitive_tag"}, kinds)
+}
+
+func TestAnomalyBulkPaging(t *testing.T) {
+	config := main.AnomalyConfig{BulkPages: 5}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	var events []*main.AuditEvent
+	for i := 0; i < 10; i++ {
+		events = append(events, fetchEvent("blue@example.com", "s1", now.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Equal(t, []string{"bulk_paging"}, main.DetectAnomalies(config, nil, events))
+
+	// Pages fetched slowly
+	var slow []*main.AuditEvent
+	for i := 0; i < 10; i++ {
+		slow = append(slow, fetchEvent("blue@example.com", "s1", now.Add(time.Duration(i)*5*time.Minute)))
+	}
+	assert.Empty(t, main.DetectAnomalies(config, nil, slow))
+}
@@ -1,87 +1,347 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
+// proxyFlushInterval is interval to flush a streamed response, e.g. a large
+// download of logs, to the client.
+const proxyFlushInterval = 100 * time.Millisecond
+
 type roundTripper func(*http.Request) (*http.Response, error)
 
 func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
 
-func reverseProxy(authz *authzService, apiKey, target string) (gin.HandlerFunc, error) {
-	logger.WithFields(logrus.Fields{
-		"target": target,
-		"apikey": apiKey[:4] + "...",
-		"authz":  authz,
-	}).Info("build proxy")
+func reverseProxy(holder *authzHolder, audit *auditLogger, limiter *rateLimiter, cache *responseCache, dedup *searchDedup, router *backendRouter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ssnData, ok := c.Get("session")
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"msg": "Unauthenticated request"})
+			return
+		}
+		ssn := ssnData.(*strixUser)
+
+		reqID := c.GetString("request_id")
+
+		authzEv := newAuditEvent(c, auditAuthz, auditAllow)
+		_, span := tracer().Start(c.Request.Context(), "authz.lookup")
+		user, err := holder.lookup(ssn.UserID, ssn.Groups)
+		endSpan(span, err)
+		if err != nil {
+			authzEv.Outcome = auditDeny
+			authzEv.Reason = err.Error()
+			audit.log(authzEv)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"msg": err.Error()})
+			return
+		}
+		if user == nil {
+			authzEv.Outcome = auditDeny
+			authzEv.Reason = "Unauthorized user"
+			audit.log(authzEv)
+			c.JSON(http.StatusUnauthorized, gin.H{"msg": "Unauthorized user", "user": user})
+			return
+		}
+
+		authzEv.Roles = user.roles()
+		authzEv.PermittedTags = user.effectiveTags()
+		audit.log(authzEv)
+
+		permittedTags := strings.Join(user.effectiveTags(), ",")
+
+		// Search creation records the query and result fetches record size
+		// of the response
+		ev := newAuditEvent(c, auditSearchFetch, auditSuccess)
+		ev.Roles = user.roles()
+		ev.PermittedTags = user.effectiveTags()
+		if c.Request.Method == http.MethodPost {
+			ev.Type = auditSearchCreate
+			ev.Search = newAuditSearch(readAuditBody(c.Request))
+		} else {
+			ev.Search = &auditSearch{
+				SearchID: c.Param("search_id"),
+				Params:   c.Request.URL.RawQuery,
+			}
+		}
+
+		target, err := selectTarget(c, router, user)
+		if err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, errBackendNotFound) {
+				status = http.StatusBadRequest
+			}
+			ev.Outcome = auditDeny
+			ev.Reason = err.Error()
+			ev.Result = &auditResult{Status: status}
+			audit.log(ev)
+			c.JSON(status, gin.H{"msg": err.Error()})
+			return
+		}
+		ev.Search.Backend = target.name()
+		c.Set("backend", target.name())
+
+		limit := limiter.limitOf(user)
+		if ok, wait := limiter.allow(ssn.UserID, limit); !ok {
+			ev.Outcome = auditDeny
+			ev.Reason = "Rate limit exceeded"
+			ev.Result = &auditResult{Status: http.StatusTooManyRequests}
+			audit.log(ev)
+			abortTooManyRequests(c, wait, "Rate limit exceeded")
+			return
+		}
+
+		isCreate := c.Request.Method == http.MethodPost
+		isStatus := strings.HasSuffix(c.FullPath(), "/:search_id")
+
+		// An identical search created recently is reused
+		dedupKey := ""
+		if isCreate && dedup.enabled() {
+			dedupKey = searchDedupKey(ev.Search.Body, target.name(), user.effectiveTags())
+			if searchID := dedup.find(dedupKey, time.Now()); searchID != "" {
+				ev.Search.SearchID = searchID
+				ev.Result = &auditResult{Status: http.StatusOK, Cache: cacheDedup}
+				audit.log(ev)
+				c.Header("X-Strix-Cache", cacheDedup)
+				c.JSON(http.StatusOK, gin.H{"search_id": searchID})
+				return
+			}
+		}
+
+		if isCreate && !limiter.startSearch(ssn.UserID, reqID, limit) {
+			ev.Outcome = auditDeny
+			ev.Reason = "Too many running searches"
+			ev.Result = &auditResult{Status: http.StatusTooManyRequests}
+			audit.log(ev)
+			abortTooManyRequests(c, concurrentRetryAfter, "Too many running searches")
+			return
+		}
+
+		isLogs := strings.HasSuffix(c.FullPath(), "/logs")
+		writer := newAuditResponseWriter(c.Writer, isCreate || isStatus, isLogs)
+		c.Writer = writer
+
+		// Results of federated searches and cacheable responses are shared
+		// by identical requests. The upstream request is not canceled by
+		// the first client leaving because other clients may wait for it.
+		header := http.Header{}
+		header.Set("Content-Type", c.GetHeader("Content-Type"))
+		header.Set("x-permitted-tags", permittedTags)
+		header.Set("x-request-id", reqID)
+		fed := &federation{ctx: context.WithoutCancel(c.Request.Context()), header: header}
+
+		cacheStatus := ""
+		switch {
+		case isCreate && target.federated != nil:
+			body, err := readBody(c.Request)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+				break
+			}
+			query := c.Request.URL.Query()
+			query.Del("backend")
+			fed.create(target.federated, c.Request.URL.Path, query, body).writeTo(c.Writer)
+
+		case isCreate:
+			newBackendProxy(router, target, c.Param("search_id"), permittedTags, reqID, true).ServeHTTP(c.Writer, c.Request)
+
+		case target.federatedID == nil && !cache.cacheable(ev.Search.SearchID, isStatus):
+			// Streamed with context of the request to be canceled when
+			// the client leaves
+			cacheStatus = cacheBypass
+			c.Header("X-Strix-Cache", cacheStatus)
+			newBackendProxy(router, target, c.Param("search_id"), permittedTags, reqID, false).ServeHTTP(c.Writer, c.Request)
+
+		default:
+			key := responseCacheKey(c.Request, user.effectiveTags())
+			var resp *cachedResponse
+			resp, cacheStatus = cache.do(key, ev.Search.SearchID, isStatus, func() *cachedResponse {
+				if target.federatedID != nil {
+					suffix := c.FullPath()[strings.Index(c.FullPath(), ":search_id")+len(":search_id"):]
+					return fed.get(router, target.federatedID, c.Param("search_id"), c.Request.URL.Path, suffix, c.Request.URL.Query())
+				}
+
+				buf := newResponseBuffer()
+				proxy := newBackendProxy(router, target, c.Param("search_id"), permittedTags, reqID, false)
+				proxy.ServeHTTP(buf, c.Request.Clone(fed.ctx))
+				return buf.response()
+			})
+			c.Header("X-Strix-Cache", cacheStatus)
+			resp.writeTo(c.Writer)
+		}
+
+		ev.Result = writer.result()
+		ev.Result.Cache = cacheStatus
+		if ev.Result.searchID != "" {
+			ev.Search.SearchID = ev.Result.searchID
+		}
+		if dedupKey != "" && ev.Result.Status < 300 && ev.Result.searchID != "" {
+			dedup.put(dedupKey, ev.Result.searchID, time.Now())
+		}
+		if isStatus && dedup.enabled() {
+			dedup.searchStatus(ev.Search.SearchID, ev.Result.status)
+		}
+		if isCreate {
+			limiter.searchCreated(ssn.UserID, reqID, ev.Result.searchID)
+		}
+		if isStatus {
+			limiter.searchStatus(ssn.UserID, ev.Search.SearchID, ev.Result.status)
+		}
+		if ev.Result.Status >= 400 {
+			ev.Outcome = auditFailure
+		}
+		audit.log(ev)
+	}
+}
+
+// searchTarget is backend(s) of a request. federated is set for creation of
+// a federated search and federatedID is set for a request of it.
+type searchTarget struct {
+	backend     *minervaBackend
+	rawID       string
+	federated   []*minervaBackend
+	federatedID *federatedID
+}
+
+func (x *searchTarget) name() string {
+	switch {
+	case x.backend != nil:
+		return x.backend.Name
+	case x.federatedID != nil:
+		var names []string
+		for name := range x.federatedID.Searches {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	default:
+		var names []string
+		for _, b := range x.federated {
+			names = append(names, b.Name)
+		}
+		return strings.Join(names, ",")
+	}
+}
+
+// selectTarget selects backend of a new search by "backend" and "tags"
+// parameters or backend of an existing search by search ID.
+func selectTarget(c *gin.Context, router *backendRouter, user *authzUser) (*searchTarget, error) {
+	var err error
+	target := &searchTarget{}
+	searchID := c.Param("search_id")
+
+	switch {
+	case c.Request.Method == http.MethodPost && isFederatedSelector(c.Query("backend")):
+		target.federated, err = router.federated(user, c.Query("backend"))
+	case c.Request.Method == http.MethodPost:
+		target.backend, err = router.route(user, c.Query("backend"), requestedTags(c.Query("tags"), user))
+	case isFederatedID(searchID):
+		target.federatedID, err = router.resolveFederated(user, searchID)
+	default:
+		target.backend, target.rawID, err = router.resolve(user, searchID)
+	}
 
-	url, err := url.Parse(target)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Fail to parse endpoint URL: %v", target)
+		return nil, err
 	}
+	return target, nil
+}
+
+// newBackendProxy builds a reverse proxy to the backend of target. Search ID
+// in path is replaced with one of the backend and search ID of a new search
+// is prefixed with the backend name.
+func newBackendProxy(router *backendRouter, target *searchTarget, searchID, permittedTags, reqID string, isCreate bool) *httputil.ReverseProxy {
+	backend := target.backend
+	proxy := &httputil.ReverseProxy{
+		Transport:     roundTripper(backend.roundTrip),
+		ErrorHandler:  upstreamErrorHandler(backend.Name),
+		FlushInterval: proxyFlushInterval,
+		Director: func(req *http.Request) {
+			path := req.URL.Path
+			if target.rawID != searchID {
+				path = strings.Replace(path, "/search/"+searchID, "/search/"+target.rawID, 1)
+			}
+			if qs := req.URL.Query(); qs.Has("backend") {
+				qs.Del("backend")
+				req.URL.RawQuery = qs.Encode()
+			}
 
-	requestHandler := func(req *http.Request) (*http.Response, error) {
-		req.Host = url.Host
-		return http.DefaultTransport.RoundTrip(req)
+			backend.direct(req, path)
+			req.Header.Set("x-permitted-tags", permittedTags)
+			req.Header.Set("x-request-id", reqID)
+		},
 	}
 
+	if isCreate && router.prefixed() {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			return rewriteSearchID(resp, func(id string) string {
+				return router.searchID(backend, id)
+			})
+		}
+	}
+
+	return proxy
+}
+
+// getMe returns resolved authorization of the caller so that UI can explain
+// what the user is able to search. Limits are rate limit and concurrent
+// searches applied to the user. Time-bound grants are not returned because
+// the authz table has no grant with expiry yet.
+func getMe(holder *authzHolder, limiter *rateLimiter, router *backendRouter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userData, ok := c.Get("user")
+		ssnData, ok := c.Get("session")
 		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{"msg": "Unauthenticated request"})
 			return
 		}
+		ssn := ssnData.(*strixUser)
 
-		userID := userData.(string)
-		user := authz.lookup(userID)
-		if user == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"msg": "Unauthorized user", "user": user})
+		user, err := holder.lookup(ssn.UserID, ssn.Groups)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"msg": err.Error()})
 			return
 		}
 
-		permittedTags := strings.Join(user.permitted(), ",")
-		if permittedTags == "" {
-			permittedTags = "*"
-		}
-
-		reqID := uuid.New().String()
-		logger.WithFields(logrus.Fields{
-			"user":          user.UserID,
-			"permittedTags": permittedTags,
-			"path":          c.FullPath(),
-			"ipaddr":        c.ClientIP(),
-			"user_agent":    c.Request.UserAgent(),
-			"request_id":    reqID,
-		}).Info("Audit log")
-
-		(&httputil.ReverseProxy{
-			Transport: roundTripper(requestHandler),
-			Director: func(req *http.Request) {
-				req.URL.Host = url.Host
-				req.URL.Scheme = url.Scheme
-				req.URL.Path = url.Path + req.URL.Path
-				req.Header.Set("x-api-key", apiKey)
-				req.Header.Set("x-permitted-tags", permittedTags)
-				req.Header.Set("x-request-id", reqID)
+		resp := gin.H{
+			"user":       ssn.UserID,
+			"groups":     ssn.Groups,
+			"authorized": false,
+			"session": gin.H{
+				"expires_at": ssn.ExpiresAt,
 			},
-		}).ServeHTTP(c.Writer, c.Request)
+		}
 
-	}, nil
-}
+		if user != nil {
+			resp["authorized"] = true
+			resp["roles"] = user.roles()
+			resp["matched_by"] = user.matchedBy
+			resp["permitted_tags"] = user.effectiveTags()
+			resp["admin"] = user.admin()
+			// 0 means no limit
+			resp["limits"] = limiter.limitOf(user)
 
-func setupAPI(authz *authzService, apiKey, endpoint string, r *gin.RouterGroup) error {
-	proxy, err := reverseProxy(authz, apiKey, endpoint)
-	if err != nil {
-		return err
+			var backends []string
+			for _, b := range router.available(user) {
+				backends = append(backends, b.Name)
+			}
+			resp["backends"] = backends
+		}
+
+		c.JSON(http.StatusOK, resp)
 	}
+}
+
+func setupAPI(authz *authzHolder, audit *auditLogger, limiter *rateLimiter, cache *responseCache, dedup *searchDedup, router *backendRouter, r *gin.RouterGroup) error {
+	proxy := reverseProxy(authz, audit, limiter, cache, dedup, router)
+
+	r.GET("/me", getMe(authz, limiter, router))
+	r.GET("/admin/audit", getAuditEvents(authz, audit))
 
 	r.POST("/search", proxy)
 	r.GET("/search/:search_id", proxy)
@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type meResponse struct {
+	User          string   `json:"user"`
+	Authorized    bool     `json:"authorized"`
+	Roles         []string `json:"roles"`
+	MatchedBy     string   `json:"matched_by"`
+	PermittedTags []string `json:"permitted_tags"`
+	Admin         bool     `json:"admin"`
+	Backends      []string `json:"backends"`
+	Limits        *struct {
+		PerMinute     float64 `json:"per_minute"`
+		Burst         int     `json:"burst"`
+		MaxConcurrent int     `json:"max_concurrent_searches"`
+	} `json:"limits"`
+	Session struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"session"`
+}
+
+func TestGetMe(t *testing.T) {
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: "http://127.0.0.1:1", APIKey: "tokyo-key"},
+			{Name: "osaka", Endpoint: "http://127.0.0.1:1", APIKey: "osaka-key"},
+		},
+	})
+	require.NoError(t, err)
+
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [
+			{"name": "analyst", "permitted_tags": ["web", "db"], "backends": ["tokyo"],
+			 "rate_limit": {"per_minute": 30, "burst": 5, "max_concurrent_searches": 2}},
+			{"name": "viewer", "permitted_tags": ["web"]}
+		],
+		"users": [{"user_id": "blue@example.com", "role": "analyst"}],
+		"rules": [{"user_regex": "@example.org$", "role": "viewer"}]
+	}`))
+	require.NoError(t, err)
+
+	handler := main.NewProxyServer(main.NewAuthzHolder(srv, false), router, main.NewResponseCache(0, 0))
+	getMe := func(user string) *meResponse {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp meResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return &resp
+	}
+
+	t.Run("user", func(t *testing.T) {
+		resp := getMe("blue@example.com")
+		assert.Equal(t, "blue@example.com", resp.User)
+		assert.True(t, resp.Authorized)
+		assert.Equal(t, []string{"analyst"}, resp.Roles)
+		assert.Equal(t, "user", resp.MatchedBy)
+		assert.Equal(t, []string{"web", "db"}, resp.PermittedTags)
+		assert.False(t, resp.Admin)
+		assert.Equal(t, []string{"tokyo"}, resp.Backends)
+		require.NotNil(t, resp.Limits)
+		assert.Equal(t, float64(30), resp.Limits.PerMinute)
+		assert.Equal(t, 5, resp.Limits.Burst)
+		assert.Equal(t, 2, resp.Limits.MaxConcurrent)
+		assert.True(t, resp.Session.ExpiresAt.After(time.Now()))
+	})
+
+	t.Run("rule", func(t *testing.T) {
+		resp := getMe("orange@example.org")
+		assert.True(t, resp.Authorized)
+		assert.Equal(t, []string{"viewer"}, resp.Roles)
+		assert.Equal(t, "rule:@example.org$", resp.MatchedBy)
+		assert.Equal(t, []string{"web"}, resp.PermittedTags)
+		assert.ElementsMatch(t, []string{"tokyo", "osaka"}, resp.Backends)
+		require.NotNil(t, resp.Limits)
+		assert.Equal(t, 0, resp.Limits.MaxConcurrent)
+	})
+
+	t.Run("no permission", func(t *testing.T) {
+		resp := getMe("red@example.net")
+		assert.Equal(t, "red@example.net", resp.User)
+		assert.False(t, resp.Authorized)
+		assert.Nil(t, resp.Roles)
+		assert.Empty(t, resp.MatchedBy)
+		assert.Nil(t, resp.PermittedTags)
+		assert.Nil(t, resp.Backends)
+		assert.Nil(t, resp.Limits)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// File names of keys in API key directory, e.g. a mounted Kubernetes secret
+const (
+	apiKeyPrimaryFile   = "primary"
+	apiKeySecondaryFile = "secondary"
+)
+
+// apiKeyFingerprint identifies a key in logs without exposing it.
+func apiKeyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(h[:])[:12]
+}
+
+// apiKeyStore has primary and secondary API keys of a backend. The secondary
+// key is used while rotating keys. Keys are static or loaded from a file
+// having primary key in the first line and secondary key in the second
+// line, or a directory having "primary" and "secondary" files.
+type apiKeyStore struct {
+	backend string
+	path    string
+
+	mutex     sync.RWMutex
+	primary   string
+	secondary string
+}
+
+func newStaticAPIKeyStore(backend, key string) *apiKeyStore {
+	return &apiKeyStore{backend: backend, primary: key}
+}
+
+func newFileAPIKeyStore(backend, path string) (*apiKeyStore, error) {
+	store := &apiKeyStore{backend: backend, path: path}
+	if _, err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func readAPIKeys(path string) (string, string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Fail to read API key: %s", path)
+	}
+
+	var keys []string
+	if stat.IsDir() {
+		for _, name := range []string{apiKeyPrimaryFile, apiKeySecondaryFile} {
+			raw, err := ioutil.ReadFile(filepath.Join(path, name))
+			if os.IsNotExist(err) {
+				keys = append(keys, "")
+				continue
+			} else if err != nil {
+				return "", "", errors.Wrapf(err, "Fail to read API key: %s", filepath.Join(path, name))
+			}
+			keys = append(keys, strings.TrimSpace(string(raw)))
+		}
+	} else {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "Fail to read API key: %s", path)
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				keys = append(keys, line)
+			}
+		}
+		keys = append(keys, "", "")
+	}
+
+	if keys[0] == "" {
+		return "", "", errors.Errorf("No primary API key in %s", path)
+	}
+	return keys[0], keys[1], nil
+}
+
+// reload reads keys from the file and returns true if keys are changed.
+func (x *apiKeyStore) reload() (bool, error) {
+	if x.path == "" {
+		return false, nil
+	}
+
+	primary, secondary, err := readAPIKeys(x.path)
+	if err != nil {
+		return false, err
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if primary == x.primary && secondary == x.secondary {
+		return false, nil
+	}
+	x.primary, x.secondary = primary, secondary
+	return true, nil
+}
+
+func (x *apiKeyStore) keys() (string, string) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.primary, x.secondary
+}
+
+func (x *apiKeyStore) logFields() logrus.Fields {
+	primary, secondary := x.keys()
+	fields := logrus.Fields{
+		"backend": x.backend,
+		"apikey":  apiKeyFingerprint(primary),
+	}
+	if secondary != "" {
+		fields["secondary_apikey"] = apiKeyFingerprint(secondary)
+	}
+	return fields
+}
+
+// watch re-reads the key file in interval. The current keys are kept if the
+// file can not be read, e.g. while being replaced.
+func (x *apiKeyStore) watch(ctx context.Context, interval time.Duration) {
+	if x.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := x.reload()
+			if err != nil {
+				logger.WithError(err).WithField("backend", x.backend).Warn("Fail to reload API key, keep current key")
+			} else if changed {
+				logger.WithFields(x.logFields()).Info("API key reloaded")
+			}
+		}
+	}
+}
+
+// apiKeyTransport sets API key to requests. A request rejected with 403 is
+// sent again with the secondary key if it's available.
+type apiKeyTransport struct {
+	base  http.RoundTripper
+	store *apiKeyStore
+}
+
+func (x *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	primary, secondary := x.store.keys()
+	if secondary == "" {
+		return x.base.RoundTrip(withAPIKey(req, primary, req.Body))
+	}
+
+	// Request body is buffered to be sent twice
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		raw, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to read request body")
+		}
+		body = raw
+	}
+
+	resp, err := x.base.RoundTrip(withAPIKey(req, primary, bodyOf(body)))
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	logger.WithFields(x.store.logFields()).Warn("Primary API key is rejected, retry with secondary key")
+	return x.base.RoundTrip(withAPIKey(req, secondary, bodyOf(body)))
+}
+
+func bodyOf(body []byte) io.ReadCloser {
+	if body == nil {
+		return http.NoBody
+	}
+	return ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// withAPIKey returns a copy of req with API key and body because
+// RoundTripper must not modify the original request.
+func withAPIKey(req *http.Request, key string, body io.ReadCloser) *http.Request {
+	keyed := req.Clone(req.Context())
+	keyed.Body = body
+	keyed.Header.Set("x-api-key", key)
+	return keyed
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyRecorder is a stub of Minerva accepting only valid key and recording
+// keys and bodies of requests.
+type keyRecorder struct {
+	mutex  sync.Mutex
+	valid  string
+	keys   []string
+	bodies []string
+}
+
+func (x *keyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.keys = append(x.keys, r.Header.Get("x-api-key"))
+	x.bodies = append(x.bodies, string(body))
+
+	if r.Header.Get("x-api-key") != x.valid {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	stub := &keyRecorder{valid: "new-key"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "apikey")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("old-key\nnew-key\n"), 0600))
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: srv.URL, APIKeyFile: keyFile},
+		},
+	})
+	require.NoError(t, err)
+
+	// Rejected by primary key and accepted by secondary key with same body
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodPost, "/api/v1/search", `{"query":[]}`))
+	assert.Equal(t, []string{"old-key", "new-key"}, stub.keys)
+	assert.Equal(t, []string{`{"query":[]}`, `{"query":[]}`}, stub.bodies)
+
+	// Rotation completed
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("new-key\n"), 0600))
+	changed, err := main.APIKeyReload(router, "tokyo")
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	stub.keys = nil
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, []string{"new-key"}, stub.keys)
+
+	// Current key is kept if the file is broken
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("\n"), 0600))
+	_, err = main.APIKeyReload(router, "tokyo")
+	assert.Error(t, err)
+
+	stub.keys = nil
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, []string{"new-key"}, stub.keys)
+
+	// Without secondary key, 403 is returned as is
+	stub.valid = "newer-key"
+	stub.keys = nil
+	assert.Equal(t, http.StatusForbidden, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, []string{"new-key"}, stub.keys)
+}
+
+func TestAPIKeyDirectory(t *testing.T) {
+	stub := &keyRecorder{valid: "secondary-key"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	keyDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(keyDir, "primary"), []byte("primary-key\n"), 0600))
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: srv.URL, APIKeyFile: keyDir},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(keyDir, "secondary"), []byte("secondary-key"), 0600))
+	changed, err := main.APIKeyReload(router, "tokyo")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+
+	require.NoError(t, os.Remove(filepath.Join(keyDir, "primary")))
+	_, err = main.APIKeyReload(router, "tokyo")
+	assert.Error(t, err)
+}
+
+func TestAPIKeyFingerprint(t *testing.T) {
+	fp := main.APIKeyFingerprint("my-secret-api-key")
+	assert.NotContains(t, fp, "my-s")
+	assert.Equal(t, fp, main.APIKeyFingerprint("my-secret-api-key"))
+	assert.NotEqual(t, fp, main.APIKeyFingerprint("my-secret-api-key2"))
+}
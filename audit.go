@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditLogin        = "login"
+	auditLogout       = "logout"
+	auditAuthn        = "authn"
+	auditAuthz        = "authz"
+	auditSearchCreate = "search.create"
+	auditSearchFetch  = "search.fetch"
+	auditView         = "audit.view"
+
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditAllow   = "allow"
+	auditDeny    = "deny"
+)
+
+type auditSearch struct {
+	SearchID string          `json:"search_id,omitempty"`
+	Backend  string          `json:"backend,omitempty"`
+	Terms    []string        `json:"terms,omitempty"`
+	StartDT  string          `json:"start_dt,omitempty"`
+	EndDT    string          `json:"end_dt,omitempty"`
+	Params   string          `json:"params,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+}
+
+// newAuditSearch extracts query terms and time range from body of POST
+// /search. The body is kept as it is in case it has other fields.
+func newAuditSearch(body json.RawMessage) *auditSearch {
+	search := &auditSearch{Body: body}
+
+	var req struct {
+		Query []struct {
+			Term string `json:"term"`
+		} `json:"query"`
+		StartDT string `json:"start_dt"`
+		EndDT   string `json:"end_dt"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return search
+	}
+
+	for _, q := range req.Query {
+		search.Terms = append(search.Terms, q.Term)
+	}
+	search.StartDT = req.StartDT
+	search.EndDT = req.EndDT
+
+	return search
+}
+
+type auditResult struct {
+	Status   int      `json:"status"`
+	Bytes    int64    `json:"bytes"`
+	Rows     *int     `json:"rows,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Cache    string   `json:"cache,omitempty"`
+	searchID string
+	status   string
+}
+
+// auditEvent is a record of audit trail. Seq, Time, PrevHash and Hash are
+// filled by auditLogger.
+type auditEvent struct {
+	Seq           uint64       `json:"seq"`
+	Time          time.Time    `json:"time"`
+	Type          string       `json:"type"`
+	Outcome       string       `json:"outcome"`
+	Reason        string       `json:"reason,omitempty"`
+	RequestID     string       `json:"request_id,omitempty"`
+	TraceID       string       `json:"trace_id,omitempty"`
+	User          string       `json:"user,omitempty"`
+	Roles         []string     `json:"roles,omitempty"`
+	PermittedTags []string     `json:"permitted_tags,omitempty"`
+	IPAddr        string       `json:"ipaddr,omitempty"`
+	UserAgent     string       `json:"user_agent,omitempty"`
+	Method        string       `json:"method,omitempty"`
+	Path          string       `json:"path,omitempty"`
+	Provider      string       `json:"provider,omitempty"`
+	Search        *auditSearch `json:"search,omitempty"`
+	Result        *auditResult `json:"result,omitempty"`
+	PrevHash      string       `json:"prev_hash"`
+	Hash          string       `json:"hash,omitempty"`
+}
+
+// newAuditEvent fills request attributes of gin context.
+func newAuditEvent(c *gin.Context, eventType, outcome string) *auditEvent {
+	ev := &auditEvent{
+		Type:      eventType,
+		Outcome:   outcome,
+		IPAddr:    c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		TraceID:   traceID(c.Request.Context()),
+	}
+
+	if v, ok := c.Get("request_id"); ok {
+		ev.RequestID = v.(string)
+	}
+	if v, ok := c.Get("session"); ok {
+		ev.User = v.(*strixUser).UserID
+	}
+
+	return ev
+}
+
+// auditSink is a destination of audit records. A record is a JSON line
+// without the trailing newline.
+type auditSink interface {
+	write(record []byte) error
+	flush() error
+	close() error
+}
+
+// auditLogger writes audit events to sinks. Each record has hash of the
+// previous record (prev_hash) and its own hash, so that removal or
+// modification of records can be detected by verifyAuditChain.
+type auditLogger struct {
+	mutex     sync.Mutex
+	sinks     []auditSink
+	observers []auditObserver
+	seq       uint64
+	prevHash  string
+}
+
+// auditObserver receives every sealed audit event, e.g. to detect anomaly.
+// observe is called while holding the lock of auditLogger and must not block.
+type auditObserver interface {
+	observe(ev *auditEvent)
+}
+
+func newAuditLogger(sinks ...auditSink) *auditLogger {
+	return &auditLogger{sinks: sinks}
+}
+
+// resume continues the hash chain from the last record written previously.
+func (x *auditLogger) resume(last *auditEvent) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.seq = last.Seq
+	x.prevHash = last.Hash
+}
+
+func (x *auditLogger) subscribe(observer auditObserver) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.observers = append(x.observers, observer)
+}
+
+func (x *auditLogger) log(ev *auditEvent) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.seq++
+	ev.Seq = x.seq
+	ev.Time = time.Now().UTC()
+	ev.PrevHash = x.prevHash
+	ev.Hash = ""
+
+	record, hash, err := sealAuditEvent(ev)
+	if err != nil {
+		logger.WithError(err).WithField("event", ev).Error("Fail to build audit record")
+		return
+	}
+	ev.Hash = hash
+	x.prevHash = hash
+
+	for _, sink := range x.sinks {
+		if err := sink.write(record); err != nil {
+			logger.WithError(err).Error("Fail to write audit record")
+		}
+	}
+
+	for _, observer := range x.observers {
+		observer.observe(ev)
+	}
+}
+
+// files returns audit log files that can be queried. It returns nil if no
+// file sink is configured.
+func (x *auditLogger) files() ([]string, error) {
+	for _, sink := range x.sinks {
+		if fileSink, ok := sink.(*fileAuditSink); ok {
+			return fileSink.files()
+		}
+	}
+	return nil, nil
+}
+
+func (x *auditLogger) flush() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var failed error
+	for _, sink := range x.sinks {
+		if err := sink.flush(); err != nil {
+			failed = err
+			logger.WithError(err).Error("Fail to flush audit sink")
+		}
+	}
+	return failed
+}
+
+func (x *auditLogger) close() error {
+	if err := x.flush(); err != nil {
+		return err
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, sink := range x.sinks {
+		if err := sink.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const auditHashField = `,"hash":"`
+
+// sealAuditEvent returns a JSON record with hash as the last field. The hash
+// is SHA-256 of prev_hash and the record without the hash field. Because hash
+// is always the last field, a verifier can recover the hashed bytes by
+// stripping it without re-encoding the record.
+func sealAuditEvent(ev *auditEvent) ([]byte, string, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Fail to marshal audit event")
+	}
+
+	hash := auditHash(ev.PrevHash, body)
+	record := append(body[:len(body)-1], []byte(auditHashField+hash+`"}`)...)
+	return record, hash, nil
+}
+
+func auditHash(prevHash string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyAuditChain checks records read from r. prev is the hash of the
+// record before the first one in r (empty for the beginning of the chain)
+// and the hash of the last record is returned.
+func verifyAuditChain(r io.Reader, prev string) (string, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		n++
+
+		var ev auditEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return prev, n, errors.Wrapf(err, "Invalid audit record at line %d", n)
+		}
+
+		idx := bytes.LastIndex(line, []byte(auditHashField))
+		if idx < 0 {
+			return prev, n, fmt.Errorf("No hash in audit record seq %d", ev.Seq)
+		}
+		body := append(append([]byte{}, line[:idx]...), '}')
+
+		if prev != "" && ev.PrevHash != prev {
+			return prev, n, fmt.Errorf("Broken chain at seq %d: prev_hash %s, expected %s", ev.Seq, ev.PrevHash, prev)
+		}
+		if hash := auditHash(ev.PrevHash, body); hash != ev.Hash {
+			return prev, n, fmt.Errorf("Hash mismatch at seq %d: %s, expected %s", ev.Seq, ev.Hash, hash)
+		}
+		prev = ev.Hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return prev, n, errors.Wrap(err, "Fail to read audit records")
+	}
+
+	return prev, n, nil
+}
+
+// verifyAuditFiles verifies files in the order of the chain, e.g. rotated
+// files from the oldest and the current file at last.
+func verifyAuditFiles(paths []string) error {
+	prev := ""
+	for _, path := range paths {
+		fd, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to open audit file: %s", path)
+		}
+
+		last, n, err := verifyAuditChain(fd, prev)
+		fd.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Verification failed: %s", path)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"file":    path,
+			"records": n,
+		}).Info("Audit chain verified")
+		prev = last
+	}
+
+	return nil
+}
+
+const (
+	auditMaxBody    = 1024 * 1024
+	auditMaxCapture = 1024 * 1024
+)
+
+// readAuditBody reads request body up to auditMaxBody bytes for audit and
+// restores the body to be forwarded.
+func readAuditBody(req *http.Request) json.RawMessage {
+	if req.Body == nil {
+		return nil
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, auditMaxBody+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(raw), req.Body), req.Body}
+	if err != nil {
+		logger.WithError(err).Warn("Fail to read request body for audit")
+		return nil
+	}
+
+	return auditBody(raw)
+}
+
+// auditBody converts body to JSON. Body that is not JSON or too large is
+// recorded as a JSON string.
+func auditBody(raw []byte) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	if len(raw) <= auditMaxBody && json.Valid(raw) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err == nil {
+			return buf.Bytes()
+		}
+	}
+
+	if len(raw) > auditMaxBody {
+		raw = raw[:auditMaxBody]
+	}
+	encoded, _ := json.Marshal(string(raw))
+	return encoded
+}
+
+// decodeContent returns reader of decompressed body by Content-Encoding.
+func decodeContent(body io.Reader, encoding string) (io.Reader, error) {
+	if encoding == "gzip" {
+		return gzip.NewReader(body)
+	}
+	return body, nil
+}
+
+// auditResponseWriter counts bytes of response and captures the body if
+// capture is enabled. Logs in a response of search logs are counted by
+// auditLogCounter instead of capturing the response that may be large.
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	bytes   int64
+	capture *bytes.Buffer
+	logs    *auditLogCounter
+	counted bool
+}
+
+func newAuditResponseWriter(w gin.ResponseWriter, capture, countLogs bool) *auditResponseWriter {
+	writer := &auditResponseWriter{ResponseWriter: w, counted: !countLogs}
+	if capture {
+		writer.capture = &bytes.Buffer{}
+	}
+	return writer
+}
+
+func (x *auditResponseWriter) Write(b []byte) (int, error) {
+	n, err := x.ResponseWriter.Write(b)
+	x.bytes += int64(n)
+
+	if x.capture != nil {
+		if x.capture.Len()+n > auditMaxCapture {
+			x.capture = nil
+		} else {
+			x.capture.Write(b[:n])
+		}
+	}
+
+	// Status and Content-Encoding are fixed by the first write
+	if !x.counted {
+		x.counted = true
+		if x.Status() < 300 {
+			x.logs = newAuditLogCounter(x.Header().Get("Content-Encoding"))
+		}
+	}
+	if x.logs != nil {
+		x.logs.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (x *auditResponseWriter) WriteString(s string) (int, error) {
+	return x.Write([]byte(s))
+}
+
+// result returns status and size of the response. Number of rows and tags
+// of logs are taken from a response of search logs, search ID is taken from
+// a response of search creation and status is taken from a response of
+// search status.
+func (x *auditResponseWriter) result() *auditResult {
+	result := &auditResult{
+		Status: x.Status(),
+		Bytes:  x.bytes,
+	}
+
+	if x.logs != nil {
+		if rows, tags, err := x.logs.close(); err == nil {
+			result.Rows = &rows
+			result.Tags = tags
+		}
+	}
+
+	if x.capture != nil && x.Status() < 300 {
+		body, err := decodeContent(x.capture, x.Header().Get("Content-Encoding"))
+		if err != nil {
+			return result
+		}
+
+		var resp struct {
+			SearchID string `json:"search_id"`
+			Metadata struct {
+				Status string `json:"status"`
+			} `json:"metadata"`
+		}
+		if err := json.NewDecoder(body).Decode(&resp); err == nil {
+			result.searchID = resp.SearchID
+			result.status = resp.Metadata.Status
+		}
+	}
+
+	return result
+}
+
+// auditLogCounter counts logs and collects tags of a response of search logs
+// while the response is written. The response is decoded through a pipe and
+// not kept in memory.
+type auditLogCounter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	rows int
+	tags []string
+	err  error
+}
+
+func newAuditLogCounter(encoding string) *auditLogCounter {
+	pr, pw := io.Pipe()
+	counter := &auditLogCounter{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(counter.done)
+		// Rest of the response is drained not to block the writer
+		defer io.Copy(ioutil.Discard, pr)
+
+		body, err := decodeContent(pr, encoding)
+		if err != nil {
+			counter.err = err
+			return
+		}
+		counter.rows, counter.tags, counter.err = countAuditLogs(body)
+	}()
+
+	return counter
+}
+
+func (x *auditLogCounter) Write(b []byte) {
+	x.pw.Write(b)
+}
+
+// close finishes the response and returns number of logs and tags.
+func (x *auditLogCounter) close() (int, []string, error) {
+	x.pw.Close()
+	<-x.done
+	return x.rows, x.tags, x.err
+}
+
+// countAuditLogs reads logs of a response of search logs one by one and
+// returns number of them and their tags.
+func countAuditLogs(r io.Reader) (int, []string, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return 0, nil, fmt.Errorf("Response of logs is not JSON object")
+	}
+
+	found := false
+	rows := 0
+	var tags []string
+	seen := map[string]bool{}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, nil, err
+		}
+		if key != "logs" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return 0, nil, fmt.Errorf("logs is not array")
+		}
+		for dec.More() {
+			var log struct {
+				Tag string `json:"tag"`
+			}
+			if err := dec.Decode(&log); err != nil {
+				return 0, nil, err
+			}
+			rows++
+			if !seen[log.Tag] {
+				tags = append(tags, log.Tag)
+				seen[log.Tag] = true
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return 0, nil, err
+		}
+		found = true
+	}
+
+	if !found {
+		return 0, nil, fmt.Errorf("No logs in response")
+	}
+	return rows, tags, nil
+}
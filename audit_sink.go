@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// loggerAuditSink writes audit records to the application logger. It's used
+// when no other sink is configured.
+type loggerAuditSink struct{}
+
+func (x *loggerAuditSink) write(record []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(record, &fields); err != nil {
+		return errors.Wrap(err, "Fail to unmarshal audit record")
+	}
+
+	logger.WithFields(fields).Info("Audit log")
+	return nil
+}
+
+func (x *loggerAuditSink) flush() error { return nil }
+func (x *loggerAuditSink) close() error { return nil }
+
+// fileAuditSink appends records to a file and rotates it when the size
+// exceeds maxSize. Rotated files are named as "<path>.<timestamp>" and only
+// maxBackups files are kept.
+type fileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	fd         *os.File
+	size       int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxBackups int) (*fileAuditSink, error) {
+	sink := &fileAuditSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (x *fileAuditSink) open() error {
+	fd, err := os.OpenFile(x.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to open audit file: %s", x.path)
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Fail to stat audit file: %s", x.path)
+	}
+
+	x.fd = fd
+	x.size = info.Size()
+	return nil
+}
+
+// lastEvent returns the last record to resume the hash chain after restart.
+// If the current file is empty, e.g. just after rotation, it's taken from the
+// newest rotated file. It returns nil if there is no record.
+func (x *fileAuditSink) lastEvent() (*auditEvent, error) {
+	files, err := x.files()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		ev, err := lastAuditEvent(files[i])
+		if err != nil || ev != nil {
+			return ev, err
+		}
+	}
+	return nil, nil
+}
+
+// lastAuditEvent returns the last record in the file or nil if it's empty.
+func lastAuditEvent(path string) (*auditEvent, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to open audit file: %s", path)
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var last []byte
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "Fail to read audit file: %s", path)
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	var ev auditEvent
+	if err := json.Unmarshal(last, &ev); err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse the last audit record: %s", path)
+	}
+	return &ev, nil
+}
+
+// files returns rotated files from the oldest and the current file.
+func (x *fileAuditSink) files() ([]string, error) {
+	backups, err := filepath.Glob(x.path + ".*")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to list rotated audit files: %s", x.path)
+	}
+	sort.Strings(backups)
+
+	return append(backups, x.path), nil
+}
+
+func (x *fileAuditSink) rotate() error {
+	if err := x.fd.Close(); err != nil {
+		return errors.Wrapf(err, "Fail to close audit file: %s", x.path)
+	}
+
+	rotated := fmt.Sprintf("%s.%s", x.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(x.path, rotated); err != nil {
+		return errors.Wrapf(err, "Fail to rotate audit file: %s", x.path)
+	}
+
+	if x.maxBackups > 0 {
+		files, err := x.files()
+		if err != nil {
+			return err
+		}
+		backups := files[:len(files)-1]
+		for len(backups) > x.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return errors.Wrapf(err, "Fail to remove old audit file: %s", backups[0])
+			}
+			backups = backups[1:]
+		}
+	}
+
+	return x.open()
+}
+
+func (x *fileAuditSink) write(record []byte) error {
+	if x.maxSize > 0 && x.size > 0 && x.size+int64(len(record))+1 > x.maxSize {
+		if err := x.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := x.fd.Write(append(record, '\n'))
+	x.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to write audit file: %s", x.path)
+	}
+	return nil
+}
+
+func (x *fileAuditSink) flush() error {
+	return x.fd.Sync()
+}
+
+func (x *fileAuditSink) close() error {
+	return x.fd.Close()
+}
+
+// webhookAuditSink sends records to an HTTP endpoint as NDJSON in batches.
+// Records are queued and sent in background not to block requests.
+type webhookAuditSink struct {
+	endpoint string
+	client   *http.Client
+	queue    chan []byte
+	flushReq chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+const (
+	webhookAuditQueueSize = 4096
+	webhookAuditBatchSize = 100
+	webhookAuditInterval  = 5 * time.Second
+	webhookAuditRetry     = 3
+)
+
+func newWebhookAuditSink(endpoint string) *webhookAuditSink {
+	sink := &webhookAuditSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan []byte, webhookAuditQueueSize),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (x *webhookAuditSink) run() {
+	defer close(x.stopped)
+
+	ticker := time.NewTicker(webhookAuditInterval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := x.send(batch); err != nil {
+			logger.WithError(err).WithField("records", len(batch)).Error("Fail to send audit records to webhook")
+		}
+		batch = nil
+	}
+	drain := func() {
+		for {
+			select {
+			case record := <-x.queue:
+				batch = append(batch, record)
+				if len(batch) >= webhookAuditBatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case record := <-x.queue:
+			batch = append(batch, record)
+			if len(batch) >= webhookAuditBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-x.flushReq:
+			drain()
+			close(ack)
+		case <-x.done:
+			drain()
+			return
+		}
+	}
+}
+
+func (x *webhookAuditSink) send(batch [][]byte) error {
+	body := bytes.Join(batch, []byte("\n"))
+
+	var err error
+	for i := 0; i < webhookAuditRetry; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+
+		var resp *http.Response
+		resp, err = x.client.Post(x.endpoint, "application/x-ndjson", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("Audit webhook returned status %d", resp.StatusCode)
+	}
+
+	return err
+}
+
+func (x *webhookAuditSink) write(record []byte) error {
+	select {
+	case x.queue <- append([]byte{}, record...):
+		return nil
+	default:
+		return fmt.Errorf("Audit webhook queue is full, record is dropped")
+	}
+}
+
+func (x *webhookAuditSink) flush() error {
+	ack := make(chan struct{})
+	select {
+	case x.flushReq <- ack:
+		<-ack
+	case <-x.done:
+	}
+	return nil
+}
+
+// close sends queued records and stops the background sender.
+func (x *webhookAuditSink) close() error {
+	x.once.Do(func() { close(x.done) })
+	<-x.stopped
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// syslogAuditSink sends records to syslog with facility AUTHPRIV.
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogAuditSink connects to local syslog if addr is "local", otherwise
+// addr must be a URL such as "udp://syslog.example.com:514".
+func newSyslogAuditSink(addr string) (*syslogAuditSink, error) {
+	var network, raddr string
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse syslog address: %s", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "strix")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to connect syslog: %s", addr)
+	}
+
+	return &syslogAuditSink{writer: writer}, nil
+}
+
+func (x *syslogAuditSink) write(record []byte) error {
+	return x.writer.Info(string(record))
+}
+
+func (x *syslogAuditSink) flush() error { return nil }
+
+func (x *syslogAuditSink) close() error {
+	return x.writer.Close()
+}
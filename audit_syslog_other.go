@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "fmt"
+
+func newSyslogAuditSink(addr string) (auditSink, error) {
+	return nil, fmt.Errorf("syslog audit sink is not supported on this platform")
+}
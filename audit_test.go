@@ -0,0 +1,204 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAuditEvents(t *testing.T, path string, users ...string) {
+	audit, err := main.SetupAudit(main.Arguments{AuditFilePath: path})
+	require.NoError(t, err)
+	for _, user := range users {
+		main.AuditLog(audit, &main.AuditEvent{Type: "login", Outcome: "success", User: user})
+	}
+	require.NoError(t, main.AuditClose(audit))
+}
+
+func TestAuditChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	writeAuditEvents(t, path, "alpha@example.com", "bravo@example.com")
+	// Chain continues after restart
+	writeAuditEvents(t, path, "charlie@example.com")
+	require.NoError(t, main.VerifyAuditFiles([]string{path}))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	require.Equal(t, 3, len(lines))
+	assert.Contains(t, lines[2], `"seq":3`)
+
+	// Modified record
+	tampered := strings.Replace(string(raw), "bravo@example.com", "delta@example.com", 1)
+	require.NoError(t, ioutil.WriteFile(path, []byte(tampered), 0600))
+	assert.Error(t, main.VerifyAuditFiles([]string{path}))
+
+	// Removed record
+	removed := lines[0] + "\n" + lines[2] + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(removed), 0600))
+	assert.Error(t, main.VerifyAuditFiles([]string{path}))
+}
+
+func TestAuditChainAfterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	writeAuditEvents(t, path, "alpha@example.com", "bravo@example.com")
+	// Rotated and restarted before any record is written to the new file
+	require.NoError(t, os.Rename(path, path+".20261019T000000.000000000"))
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	writeAuditEvents(t, path)
+
+	// Chain continues from the newest rotated file
+	writeAuditEvents(t, path, "charlie@example.com")
+	files, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.NoError(t, main.VerifyAuditFiles(append(files, path)))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"seq":3`)
+}
+
+func TestNewAuditSearch(t *testing.T) {
+	search := main.NewAuditSearch([]byte(`{
+		"query": [{"term": "10.0.0.1"}, {"term": "login"}],
+		"start_dt": "2026-10-01T00:00:00",
+		"end_dt": "2026-10-02T00:00:00",
+		"tags": "web"
+	}`))
+	assert.Equal(t, []string{"10.0.0.1", "login"}, search.Terms)
+	assert.Equal(t, "2026-10-01T00:00:00", search.StartDT)
+	assert.Equal(t, "2026-10-02T00:00:00", search.EndDT)
+	// Other fields are kept in body
+	assert.Contains(t, string(search.Body), `"tags"`)
+
+	// Body that is not a search query is kept as it is
+	search = main.NewAuditSearch([]byte(`"not a query"`))
+	assert.Nil(t, search.Terms)
+	assert.Empty(t, search.StartDT)
+	assert.Equal(t, `"not a query"`, string(search.Body))
+}
+
+func TestAuditSearchEvent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost:
+			w.Write([]byte(`{"search_id":"0d5c1b2e-audit-search"}`))
+		case strings.HasSuffix(r.URL.Path, "/logs"):
+			w.Write([]byte(`{"logs":[{"tag":"web"},{"tag":"web"}],"metadata":{"total":2}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: upstream.URL, APIKey: "tokyo-key"},
+		},
+	})
+	require.NoError(t, err)
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name": "analyst", "permitted_tags": ["web"]}],
+		"users": [{"user_id": "blue@example.com", "role": "analyst"}]
+	}`))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := main.SetupAudit(main.Arguments{AuditFilePath: path})
+	require.NoError(t, err)
+	s := httptest.NewServer(main.NewAuditedProxyServer(main.NewAuthzHolder(srv, false), router, audit))
+	defer s.Close()
+
+	send := func(method, path, body string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", "blue@example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	send(http.MethodPost, "/api/v1/search", `{
+		"query": [{"term": "10.0.0.1"}],
+		"start_dt": "2026-10-01T00:00:00",
+		"end_dt": "2026-10-02T00:00:00"
+	}`)
+	send(http.MethodGet, "/api/v1/search/0d5c1b2e-audit-search/logs?offset=0&limit=50", "")
+	require.NoError(t, main.AuditClose(audit))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	events := map[string]*main.AuditEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var ev main.AuditEvent
+		require.NoError(t, json.Unmarshal([]byte(line), &ev))
+		events[ev.Type] = &ev
+	}
+
+	// Query is taken from the request and search_id from the response
+	create := events["search.create"]
+	require.NotNil(t, create)
+	require.NotNil(t, create.Search)
+	assert.Equal(t, []string{"10.0.0.1"}, create.Search.Terms)
+	assert.Equal(t, "2026-10-01T00:00:00", create.Search.StartDT)
+	assert.Equal(t, "2026-10-02T00:00:00", create.Search.EndDT)
+	assert.Equal(t, "0d5c1b2e-audit-search", create.Search.SearchID)
+	assert.Equal(t, "req-blue@example.com", create.RequestID)
+	require.NotNil(t, create.Result)
+	assert.Equal(t, http.StatusOK, create.Result.Status)
+	assert.Equal(t, int64(len(`{"search_id":"0d5c1b2e-audit-search"}`)), create.Result.Bytes)
+
+	fetch := events["search.fetch"]
+	require.NotNil(t, fetch)
+	assert.Equal(t, "0d5c1b2e-audit-search", fetch.Search.SearchID)
+	assert.Equal(t, "offset=0&limit=50", fetch.Search.Params)
+	require.NotNil(t, fetch.Result)
+	require.NotNil(t, fetch.Result.Rows)
+	assert.Equal(t, 2, *fetch.Result.Rows)
+	assert.Equal(t, []string{"web"}, fetch.Result.Tags)
+}
+
+func TestCountAuditLogs(t *testing.T) {
+	// Large response is read log by log
+	var body strings.Builder
+	body.WriteString(`{"metadata":{"total":30000},"logs":[`)
+	for i := 0; i < 30000; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"tag":"tag%d","log":{"msg":"%s"}}`, i%3, strings.Repeat("x", 100))
+	}
+	body.WriteString(`]}`)
+	rows, tags, err := main.CountAuditLogs(strings.NewReader(body.String()))
+	require.NoError(t, err)
+	assert.Equal(t, 30000, rows)
+	assert.Equal(t, []string{"tag0", "tag1", "tag2"}, tags)
+
+	rows, tags, err = main.CountAuditLogs(strings.NewReader(`{"logs":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 0, rows)
+	assert.Nil(t, tags)
+
+	_, _, err = main.CountAuditLogs(strings.NewReader(`{"metadata":{}}`))
+	assert.Error(t, err)
+	_, _, err = main.CountAuditLogs(strings.NewReader(`{"logs":null}`))
+	assert.Error(t, err)
+	_, _, err = main.CountAuditLogs(strings.NewReader(`{"logs":[{"tag":`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	auditViewDefaultLimit = 100
+	auditViewMaxLimit     = 1000
+	// Events before the page are kept in memory while scanning from the
+	// oldest, then offset is limited. Use since and until for older events.
+	auditViewMaxOffset = 100000
+
+	auditExportDefaultLimit = 10000
+	auditExportMaxLimit     = 100000
+)
+
+// auditQuery is a filter of audit events. Empty fields match everything.
+type auditQuery struct {
+	User    string
+	Type    string
+	Outcome string
+	Tag     string
+	Term    string
+	Since   time.Time
+	Until   time.Time
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func newAuditQuery(c *gin.Context) (*auditQuery, error) {
+	q := &auditQuery{
+		User:    c.Query("user"),
+		Type:    c.Query("type"),
+		Outcome: c.Query("outcome"),
+		Tag:     c.Query("tag"),
+		Term:    strings.ToLower(c.Query("term")),
+	}
+
+	if v := c.Query("since"); v != "" {
+		t, err := parseAuditTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid since: %s", v)
+		}
+		q.Since = t
+	}
+	if v := c.Query("until"); v != "" {
+		t, err := parseAuditTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid until: %s", v)
+		}
+		q.Until = t
+	}
+
+	return q, nil
+}
+
+// searchTags returns tags selected by "tags" parameter of a result fetch.
+func (x *auditSearch) searchTags() []string {
+	if x.Params == "" {
+		return nil
+	}
+
+	qs, err := url.ParseQuery(x.Params)
+	if err != nil || qs.Get("tags") == "" {
+		return nil
+	}
+	return strings.Split(qs.Get("tags"), ",")
+}
+
+func (x *auditQuery) match(ev *auditEvent) bool {
+	if x.User != "" && ev.User != x.User {
+		return false
+	}
+	if x.Type != "" && ev.Type != x.Type {
+		return false
+	}
+	if x.Outcome != "" && ev.Outcome != x.Outcome {
+		return false
+	}
+	if !x.Since.IsZero() && ev.Time.Before(x.Since) {
+		return false
+	}
+	if !x.Until.IsZero() && !ev.Time.Before(x.Until) {
+		return false
+	}
+
+	if x.Tag != "" {
+		tags := ev.PermittedTags
+		if ev.Search != nil {
+			tags = append(append([]string{}, tags...), ev.Search.searchTags()...)
+		}
+		if !containsString(tags, x.Tag) {
+			return false
+		}
+	}
+
+	if x.Term != "" {
+		if ev.Search == nil {
+			return false
+		}
+		found := false
+		for _, term := range ev.Search.Terms {
+			if strings.Contains(strings.ToLower(term), x.Term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// scanAuditFiles calls fn for each event in files from the oldest until fn
+// returns false. A broken line, e.g. partially written, is skipped.
+func scanAuditFiles(files []string, fn func(ev *auditEvent) bool) error {
+	for _, path := range files {
+		fd, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "Fail to open audit file: %s", path)
+		}
+
+		next := true
+		scanner := bufio.NewScanner(fd)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for next && scanner.Scan() {
+			var ev auditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				continue
+			}
+			next = fn(&ev)
+		}
+		err = scanner.Err()
+		fd.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Fail to read audit file: %s", path)
+		}
+		if !next {
+			break
+		}
+	}
+
+	return nil
+}
+
+// queryAuditFiles returns a page of events matched with q from the newest
+// one and the number of all matched events. Only the newest offset+limit
+// events are kept while scanning.
+func queryAuditFiles(files []string, q *auditQuery, offset, limit int) ([]*auditEvent, int, error) {
+	var events []*auditEvent
+	total := 0
+
+	err := scanAuditFiles(files, func(ev *auditEvent) bool {
+		if q.match(ev) {
+			total++
+			events = append(events, ev)
+			if len(events) > offset+limit {
+				events = events[1:]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	if offset > len(events) {
+		offset = len(events)
+	}
+	events = events[offset:]
+	if limit < len(events) {
+		events = events[:limit]
+	}
+
+	return events, total, nil
+}
+
+// exportAuditFiles calls fn for events matched with q from the oldest one,
+// skipping the first offset events and stopping after limit events.
+func exportAuditFiles(files []string, q *auditQuery, offset, limit int, fn func(ev *auditEvent) error) error {
+	var fnErr error
+	n := 0
+
+	err := scanAuditFiles(files, func(ev *auditEvent) bool {
+		if !q.match(ev) {
+			return true
+		}
+		n++
+		if n <= offset {
+			return true
+		}
+		if fnErr = fn(ev); fnErr != nil {
+			return false
+		}
+		return n < offset+limit
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+var auditCSVHeader = []string{
+	"seq", "time", "type", "outcome", "reason", "request_id", "user", "roles",
+	"permitted_tags", "ipaddr", "user_agent", "method", "path", "search_id",
+	"terms", "start_dt", "end_dt", "params", "status", "bytes", "rows", "hash",
+}
+
+// csvSafe escapes a cell that would be evaluated as a formula by spreadsheet
+// applications.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func auditCSVRow(ev *auditEvent) []string {
+	row := []string{
+		strconv.FormatUint(ev.Seq, 10),
+		ev.Time.Format(time.RFC3339Nano),
+		ev.Type,
+		ev.Outcome,
+		ev.Reason,
+		ev.RequestID,
+		ev.User,
+		strings.Join(ev.Roles, ","),
+		strings.Join(ev.PermittedTags, ","),
+		ev.IPAddr,
+		ev.UserAgent,
+		ev.Method,
+		ev.Path,
+		"", "", "", "", "",
+		"", "", "",
+		ev.Hash,
+	}
+
+	if s := ev.Search; s != nil {
+		row[13], row[14], row[15], row[16], row[17] = s.SearchID, strings.Join(s.Terms, " "), s.StartDT, s.EndDT, s.Params
+	}
+	if r := ev.Result; r != nil {
+		row[18], row[19] = strconv.Itoa(r.Status), strconv.FormatInt(r.Bytes, 10)
+		if r.Rows != nil {
+			row[20] = strconv.Itoa(*r.Rows)
+		}
+	}
+
+	for i := range row {
+		row[i] = csvSafe(row[i])
+	}
+	return row
+}
+
+func intQuery(c *gin.Context, key string, defaultValue int) (int, error) {
+	v := c.Query(key)
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s: %s", key, v)
+	}
+	return n, nil
+}
+
+// getAuditEvents provides audit log viewer for administrators. Events are
+// returned from the newest as JSON with pagination, or exported as CSV or
+// NDJSON by "format" parameter. Export is streamed from the oldest event and
+// limited to auditExportDefaultLimit events by default.
+func getAuditEvents(holder *authzHolder, audit *auditLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ssn := c.MustGet("session").(*strixUser)
+
+		ev := newAuditEvent(c, auditView, auditSuccess)
+		ev.Search = &auditSearch{Params: c.Request.URL.RawQuery}
+
+		user, err := holder.lookup(ssn.UserID, ssn.Groups)
+		if err != nil {
+			ev.Outcome = auditFailure
+			ev.Reason = err.Error()
+			ev.Result = &auditResult{Status: http.StatusServiceUnavailable}
+			audit.log(ev)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"msg": err.Error()})
+			return
+		}
+		if user == nil || !user.admin() {
+			ev.Outcome = auditDeny
+			ev.Reason = "Not administrator"
+			audit.log(ev)
+			c.JSON(http.StatusForbidden, gin.H{"msg": "Administrator only"})
+			return
+		}
+		ev.Roles = user.roles()
+
+		writer := newAuditResponseWriter(c.Writer, false, false)
+		c.Writer = writer
+		defer func() {
+			ev.Result = writer.result()
+			if ev.Result.Status >= 400 {
+				ev.Outcome = auditFailure
+			}
+			audit.log(ev)
+		}()
+
+		files, err := audit.files()
+		if err != nil {
+			logger.WithError(err).Error("Fail to list audit files")
+			c.JSON(http.StatusInternalServerError, gin.H{"msg": "Fail to read audit log"})
+			return
+		}
+		if files == nil {
+			c.JSON(http.StatusNotFound, gin.H{"msg": "Audit log file is not configured"})
+			return
+		}
+
+		q, err := newAuditQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+			return
+		}
+
+		format := c.DefaultQuery("format", "json")
+		defaultLimit, maxLimit := auditViewDefaultLimit, auditViewMaxLimit
+		switch format {
+		case "json":
+		case "csv", "ndjson":
+			defaultLimit, maxLimit = auditExportDefaultLimit, auditExportMaxLimit
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid format: " + format})
+			return
+		}
+
+		offset, err := intQuery(c, "offset", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+			return
+		}
+		limit, err := intQuery(c, "limit", defaultLimit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": err.Error()})
+			return
+		}
+		if limit == 0 || limit > maxLimit {
+			limit = maxLimit
+		}
+
+		if format == "json" {
+			if offset > auditViewMaxOffset {
+				c.JSON(http.StatusBadRequest, gin.H{"msg": fmt.Sprintf("offset must be %d or less, use since and until for older events", auditViewMaxOffset)})
+				return
+			}
+
+			events, total, err := queryAuditFiles(files, q, offset, limit)
+			if err != nil {
+				logger.WithError(err).Error("Fail to query audit log")
+				c.JSON(http.StatusInternalServerError, gin.H{"msg": "Fail to read audit log"})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"events": events,
+				"total":  total,
+				"offset": offset,
+				"limit":  limit,
+			})
+			return
+		}
+
+		var write func(ev *auditEvent) error
+		var flush func() error
+		if format == "ndjson" {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Content-Disposition", `attachment; filename="audit.ndjson"`)
+			enc := json.NewEncoder(c.Writer)
+			write = func(ev *auditEvent) error { return enc.Encode(ev) }
+			flush = func() error { return nil }
+		} else {
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", `attachment; filename="audit.csv"`)
+			w := csv.NewWriter(c.Writer)
+			w.Write(auditCSVHeader)
+			write = func(ev *auditEvent) error { return w.Write(auditCSVRow(ev)) }
+			flush = func() error { w.Flush(); return w.Error() }
+		}
+		c.Status(http.StatusOK)
+
+		err = exportAuditFiles(files, q, offset, limit, write)
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			logger.WithError(err).Error("Fail to export audit log")
+			if !c.Writer.Written() {
+				c.JSON(http.StatusInternalServerError, gin.H{"msg": "Fail to read audit log"})
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type auditPage struct {
+	Events []*main.AuditEvent `json:"events"`
+	Total  int                `json:"total"`
+	Offset int                `json:"offset"`
+	Limit  int                `json:"limit"`
+}
+
+func newAuditViewer(t *testing.T) http.Handler {
+	audit, err := main.SetupAudit(main.Arguments{AuditFilePath: filepath.Join(t.TempDir(), "audit.log")})
+	require.NoError(t, err)
+	t.Cleanup(func() { main.AuditClose(audit) })
+
+	for i := 0; i < 5; i++ {
+		main.AuditLog(audit, &main.AuditEvent{Type: "login", Outcome: "success", User: "alpha@example.com"})
+	}
+	main.AuditLog(audit, &main.AuditEvent{Type: "login", Outcome: "deny", User: "bravo@example.com"})
+	main.AuditLog(audit, &main.AuditEvent{
+		Type:          "search.create",
+		Outcome:       "success",
+		User:          "bravo@example.com",
+		PermittedTags: []string{"web"},
+		Search:        &main.AuditSearch{SearchID: "s1", Terms: []string{"=HYPERLINK(\"http://example.com\")", "-1+2"}},
+	})
+
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [
+			{"name": "auditor", "admin": true},
+			{"name": "analyst", "permitted_tags": ["web"]}
+		],
+		"users": [
+			{"user_id": "admin@example.com", "role": "auditor"},
+			{"user_id": "blue@example.com", "role": "analyst"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	return main.NewAuditViewerServer(main.NewAuthzHolder(srv, false), audit)
+}
+
+func getAudit(t *testing.T, handler http.Handler, user, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/audit?"+query, nil)
+	req.Header.Set("X-User", user)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func getAuditPage(t *testing.T, handler http.Handler, query string) *auditPage {
+	w := getAudit(t, handler, "admin@example.com", query)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var page auditPage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	return &page
+}
+
+func TestAuditViewerAdminOnly(t *testing.T) {
+	handler := newAuditViewer(t)
+
+	assert.Equal(t, http.StatusForbidden, getAudit(t, handler, "blue@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, getAudit(t, handler, "unknown@example.com", "").Code)
+	assert.Equal(t, http.StatusOK, getAudit(t, handler, "admin@example.com", "").Code)
+
+	// Denied access is also recorded
+	page := getAuditPage(t, handler, "type=audit.view&outcome=deny")
+	require.Equal(t, 2, page.Total)
+	assert.Equal(t, "unknown@example.com", page.Events[0].User)
+	assert.Equal(t, "blue@example.com", page.Events[1].User)
+}
+
+func TestAuditViewerUnavailable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := main.SetupAudit(main.Arguments{AuditFilePath: path})
+	require.NoError(t, err)
+
+	// Failure of authz lookup is also recorded
+	handler := main.NewAuditViewerServer(main.NewAuthzHolder(nil, false), audit)
+	assert.Equal(t, http.StatusServiceUnavailable, getAudit(t, handler, "admin@example.com", "").Code)
+	require.NoError(t, main.AuditClose(audit))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var ev main.AuditEvent
+	require.NoError(t, json.Unmarshal(raw, &ev))
+	assert.Equal(t, "audit.view", ev.Type)
+	assert.Equal(t, "failure", ev.Outcome)
+	assert.Equal(t, "admin@example.com", ev.User)
+	require.NotNil(t, ev.Result)
+	assert.Equal(t, http.StatusServiceUnavailable, ev.Result.Status)
+}
+
+func TestAuditViewerFilter(t *testing.T) {
+	handler := newAuditViewer(t)
+
+	page := getAuditPage(t, handler, "user=bravo@example.com")
+	require.Equal(t, 2, page.Total)
+	assert.Equal(t, "search.create", page.Events[0].Type)
+	assert.Equal(t, "login", page.Events[1].Type)
+
+	page = getAuditPage(t, handler, "type=login&outcome=deny")
+	require.Equal(t, 1, page.Total)
+	assert.Equal(t, "bravo@example.com", page.Events[0].User)
+
+	page = getAuditPage(t, handler, "tag=web&term=hyperlink")
+	require.Equal(t, 1, page.Total)
+	assert.Equal(t, "s1", page.Events[0].Search.SearchID)
+
+	assert.Equal(t, 0, getAuditPage(t, handler, "type=login&since=2999-01-01").Total)
+	assert.Equal(t, 6, getAuditPage(t, handler, "type=login&since=2000-01-01&until=2999-01-01").Total)
+
+	assert.Equal(t, http.StatusBadRequest, getAudit(t, handler, "admin@example.com", "since=yesterday").Code)
+	assert.Equal(t, http.StatusBadRequest, getAudit(t, handler, "admin@example.com", "format=xml").Code)
+}
+
+func TestAuditViewerPagination(t *testing.T) {
+	handler := newAuditViewer(t)
+
+	page := getAuditPage(t, handler, "user=alpha@example.com&offset=1&limit=3")
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 1, page.Offset)
+	assert.Equal(t, 3, page.Limit)
+	require.Equal(t, 3, len(page.Events))
+	// From the newest
+	assert.Equal(t, uint64(4), page.Events[0].Seq)
+	assert.Equal(t, uint64(2), page.Events[2].Seq)
+
+	page = getAuditPage(t, handler, "user=alpha@example.com&offset=4&limit=3")
+	assert.Equal(t, 5, page.Total)
+	require.Equal(t, 1, len(page.Events))
+	assert.Equal(t, uint64(1), page.Events[0].Seq)
+
+	page = getAuditPage(t, handler, "user=alpha@example.com&offset=10")
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 0, len(page.Events))
+
+	assert.Equal(t, 1000, getAuditPage(t, handler, "limit=5000").Limit)
+	assert.Equal(t, http.StatusBadRequest, getAudit(t, handler, "admin@example.com", "offset=-1").Code)
+	assert.Equal(t, http.StatusBadRequest, getAudit(t, handler, "admin@example.com", "offset=100001").Code)
+}
+
+func TestAuditViewerExport(t *testing.T) {
+	handler := newAuditViewer(t)
+
+	t.Run("ndjson", func(t *testing.T) {
+		w := getAudit(t, handler, "admin@example.com", "format=ndjson&user=alpha@example.com&offset=1&limit=2")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		require.Equal(t, 2, len(lines))
+		// From the oldest
+		var ev main.AuditEvent
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &ev))
+		assert.Equal(t, uint64(2), ev.Seq)
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &ev))
+		assert.Equal(t, uint64(3), ev.Seq)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := getAudit(t, handler, "admin@example.com", "format=csv&type=search.create")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(rows))
+		assert.Equal(t, "seq", rows[0][0])
+		assert.Equal(t, "bravo@example.com", rows[1][6])
+		// Formula is escaped
+		assert.Equal(t, `'=HYPERLINK("http://example.com") -1+2`, rows[1][14])
+	})
+}
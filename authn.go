@@ -25,15 +25,21 @@ const (
 type strixUser struct {
 	UserID    string    `json:"user"`
 	Image     string    `json:"image"`
+	Groups    []string  `json:"groups"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
 type sessionManager struct {
 	jwtSecret []byte
+	resolver  groupResolver
+	audit     *auditLogger
+
+	// Path of web UI, redirected to after login and logout
+	basePath string
 }
 
-func newSessionManager(jwtSecret string) *sessionManager {
-	mgr := &sessionManager{}
+func newSessionManager(jwtSecret string, audit *auditLogger) *sessionManager {
+	mgr := &sessionManager{audit: audit, basePath: "/"}
 
 	if jwtSecret == "" {
 		logger.Warn("jwt-secret is not set, then automatically generated")
@@ -52,6 +58,7 @@ func (x *sessionManager) sign(user strixUser, c *gin.Context) error {
 		"user":       user.UserID,
 		"expires_at": user.ExpiresAt,
 		"image":      user.Image,
+		"groups":     user.Groups,
 	})
 	signed, err := token.SignedString(x.jwtSecret)
 	if err != nil {
@@ -82,6 +89,24 @@ func claimToStrixUser(claims jwt.MapClaims) (*strixUser, error) {
 		return nil, fmt.Errorf("missing 'image' field in token")
 	}
 
+	// "groups" is optional for tokens issued before group support. A single
+	// group may be given as a string.
+	switch v := claims["groups"].(type) {
+	case nil:
+	case string:
+		user.Groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			group, ok := g.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid 'groups' field in token: %v", v)
+			}
+			user.Groups = append(user.Groups, group)
+		}
+	default:
+		return nil, fmt.Errorf("invalid 'groups' field in token: %v", v)
+	}
+
 	if v, ok := claims["expires_at"].(string); ok {
 		if expires, err := time.Parse("2006-01-02T15:04:05.999999Z07:00", v); err == nil {
 			user.ExpiresAt = expires
@@ -95,6 +120,44 @@ func claimToStrixUser(claims jwt.MapClaims) (*strixUser, error) {
 	return &user, nil
 }
 
+// groups merges groups given by identity provider (e.g. OIDC "groups" claim)
+// and groups resolved by groupResolver if it's configured.
+func (x *sessionManager) groups(ctx context.Context, userID string, claimed []string) ([]string, error) {
+	groups := append([]string{}, claimed...)
+	if x.resolver == nil {
+		return groups, nil
+	}
+
+	resolved, err := x.resolver.resolve(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, g := range groups {
+		seen[g] = true
+	}
+	for _, g := range resolved {
+		if !seen[g] {
+			groups = append(groups, g)
+			seen[g] = true
+		}
+	}
+
+	return groups, nil
+}
+
+func (x *sessionManager) auditLogin(c *gin.Context, provider, userID, reason string) {
+	ev := newAuditEvent(c, auditLogin, auditSuccess)
+	ev.Provider = provider
+	ev.User = userID
+	if reason != "" {
+		ev.Outcome = auditFailure
+		ev.Reason = reason
+	}
+	x.audit.log(ev)
+}
+
 func (x *sessionManager) logout(c *gin.Context) {
 	ssn := sessions.Default(c)
 	ssn.Delete(cookieKey)
@@ -167,8 +230,14 @@ func setupAuth(mgr *sessionManager, r *gin.RouterGroup) error {
 	})
 
 	r.GET("/logout", func(c *gin.Context) {
+		ev := newAuditEvent(c, auditLogout, auditSuccess)
+		if user, err := mgr.validate(c); err == nil {
+			ev.User = user.UserID
+		}
+		mgr.audit.log(ev)
+
 		mgr.logout(c)
-		c.Redirect(http.StatusFound, "/")
+		c.Redirect(http.StatusFound, mgr.basePath)
 	})
 
 	return nil
@@ -203,6 +272,13 @@ func setupAuthGoogleBase64(mgr *sessionManager, configData string, r *gin.Router
 }
 
 func setupAuthGoogle(mgr *sessionManager, conf *oauth2.Config, r *gin.RouterGroup) error {
+	// Callback URL follows base path even if it's not in redirect_uris
+	redirectURL, err := withBasePath(conf.RedirectURL, mgr.basePath)
+	if err != nil {
+		return errors.Wrap(err, "Invalid redirect URL of Google OAuth")
+	}
+	conf.RedirectURL = redirectURL
+
 	// Redirect to Google
 	r.GET("/google", func(c *gin.Context) {
 		url := conf.AuthCodeURL("state", oauth2.AccessTypeOnline)
@@ -214,12 +290,14 @@ func setupAuthGoogle(mgr *sessionManager, conf *oauth2.Config, r *gin.RouterGrou
 	// Callback from Google
 	r.GET("/google/callback", func(c *gin.Context) {
 		if errmsg := c.Query("error"); errmsg != "" {
+			mgr.auditLogin(c, "google", "", "Auth error: "+errmsg)
 			c.String(http.StatusUnauthorized, "Auth error: "+errmsg)
 			return
 		}
 
 		code := c.Query("code")
 		if code == "" {
+			mgr.auditLogin(c, "google", "", "No auth code")
 			c.String(400, "No auth code")
 			return
 		}
@@ -228,6 +306,7 @@ func setupAuthGoogle(mgr *sessionManager, conf *oauth2.Config, r *gin.RouterGrou
 		token, err := conf.Exchange(ctx, code)
 		if err != nil {
 			logger.WithError(err).Errorf("Fail to parse token from Google: %v", code)
+			mgr.auditLogin(c, "google", "", "Invalid token")
 			c.String(http.StatusInternalServerError, "Invalid Token, see system logs")
 			return
 		}
@@ -237,6 +316,7 @@ func setupAuthGoogle(mgr *sessionManager, conf *oauth2.Config, r *gin.RouterGrou
 
 		if err != nil {
 			logger.WithError(err).Errorf("Fail to get user info from Google")
+			mgr.auditLogin(c, "google", "", "Fail to get user info")
 			c.String(http.StatusInternalServerError, "Fail to authentication, see system logs")
 			return
 		}
@@ -244,43 +324,59 @@ func setupAuthGoogle(mgr *sessionManager, conf *oauth2.Config, r *gin.RouterGrou
 		defer resp.Body.Close()
 
 		var googleUser struct {
-			Sub           string `json:"sub"`
-			Picture       string `json:"picture"`
-			Email         string `json:"email"`
-			EmailVerified bool   `json:"email_verified"`
-			HD            string `json:"hd"`
+			Sub           string   `json:"sub"`
+			Picture       string   `json:"picture"`
+			Email         string   `json:"email"`
+			EmailVerified bool     `json:"email_verified"`
+			HD            string   `json:"hd"`
+			Groups        []string `json:"groups"`
 		}
 
 		raw, err := ioutil.ReadAll(resp.Body)
 		logger.WithField("user", string(raw)).Info("userinfo")
 		if err != nil {
 			logger.WithError(err).Errorf("Fail to read user info from Google")
+			mgr.auditLogin(c, "google", "", "Fail to read user info")
 			c.String(http.StatusInternalServerError, "Fail to authentication, see system logs")
 			return
 		}
 
 		if err := json.Unmarshal(raw, &googleUser); err != nil {
 			logger.WithError(err).WithField("raw", string(raw)).Errorf("Fail to parse user info from Google")
+			mgr.auditLogin(c, "google", "", "Fail to parse user info")
 			c.String(http.StatusInternalServerError, "Fail to authentication, see system logs")
 			return
 		}
 
 		logger.WithField("user", googleUser).Info("Got user info from Google")
 		if !googleUser.EmailVerified {
+			mgr.auditLogin(c, "google", googleUser.Email, "Email is not verified")
 			c.String(http.StatusUnauthorized, "Email is not verified: "+googleUser.Email)
 			return
 		}
 
+		groups, err := mgr.groups(ctx, googleUser.Email, googleUser.Groups)
+		if err != nil {
+			logger.WithError(err).WithField("user", googleUser.Email).Errorf("Fail to resolve groups")
+			mgr.auditLogin(c, "google", googleUser.Email, "Fail to resolve groups")
+			c.String(http.StatusInternalServerError, "Fail to authentication, see system logs")
+			return
+		}
+
 		user := strixUser{
 			UserID:    googleUser.Email,
 			Image:     googleUser.Picture,
+			Groups:    groups,
 			ExpiresAt: time.Now().Add(tokenDuration),
 		}
 		if err := mgr.sign(user, c); err != nil {
+			mgr.auditLogin(c, "google", user.UserID, "Fail to sign token")
 			c.String(http.StatusInternalServerError, "Authentication procedure failed")
+			return
 		}
 
-		c.Redirect(http.StatusFound, "/")
+		mgr.auditLogin(c, "google", user.UserID, "")
+		c.Redirect(http.StatusFound, mgr.basePath)
 	})
 
 	return nil
@@ -0,0 +1,57 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimToStrixUser(t *testing.T) {
+	claims := func(groups interface{}) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"user":       "blue@example.com",
+			"image":      "https://example.com/blue.png",
+			"expires_at": "2026-10-20T00:00:00Z",
+		}
+		if groups != nil {
+			c["groups"] = groups
+		}
+		return c
+	}
+
+	t.Run("groups in array", func(t *testing.T) {
+		user, err := main.ClaimToStrixUser(claims([]interface{}{"security", "sre"}))
+		require.NoError(t, err)
+		assert.Equal(t, "blue@example.com", user.UserID)
+		assert.Equal(t, []string{"security", "sre"}, user.Groups)
+	})
+
+	t.Run("single group in string", func(t *testing.T) {
+		user, err := main.ClaimToStrixUser(claims("security"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"security"}, user.Groups)
+	})
+
+	t.Run("no groups claim", func(t *testing.T) {
+		user, err := main.ClaimToStrixUser(claims(nil))
+		require.NoError(t, err)
+		assert.Nil(t, user.Groups)
+	})
+
+	t.Run("invalid groups", func(t *testing.T) {
+		_, err := main.ClaimToStrixUser(claims([]interface{}{"security", 1.0}))
+		assert.Error(t, err)
+		_, err = main.ClaimToStrixUser(claims(1.0))
+		assert.Error(t, err)
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		c := claims(nil)
+		delete(c, "user")
+		_, err := main.ClaimToStrixUser(c)
+		assert.Error(t, err)
+	})
+}
@@ -3,32 +3,128 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 type authzUser struct {
-	UserID  string `json:"user_id"`
-	Role    string `json:"role"`
-	rolePtr *authzRole
+	UserID    string `json:"user_id" yaml:"user_id"`
+	Role      string `json:"role" yaml:"role"`
+	rolePtr   *authzRole
+	roleNames []string
+	matchedBy string
+	source    string
+}
+
+// roles returns names of all roles assigned to the user. A user provisioned
+// by a directory can have multiple roles.
+func (x *authzUser) roles() []string {
+	if len(x.roleNames) > 0 {
+		return x.roleNames
+	}
+	return []string{x.Role}
 }
 
 func (x *authzUser) permitted() []string {
 	return x.rolePtr.PermittedTags
 }
 
+func (x *authzUser) admin() bool {
+	return x.rolePtr.Admin
+}
+
+// permittedBackends returns names of backends the user can search. nil
+// means no restriction.
+func (x *authzUser) permittedBackends() []string {
+	return x.rolePtr.Backends
+}
+
+// rateLimit returns rate limit of the role, nil if not set.
+func (x *authzUser) rateLimit() *rateLimit {
+	return x.rolePtr.RateLimit
+}
+
+// effectiveTags returns tags that are actually sent to Minerva. An empty
+// permitted tag list means no restriction and is sent as "*".
+func (x *authzUser) effectiveTags() []string {
+	tags := x.permitted()
+	if len(tags) == 0 {
+		return []string{"*"}
+	}
+	return tags
+}
+
 type authzRole struct {
-	Name          string   `json:"name"`
-	PermittedTags []string `json:"permitted_tags"`
+	Name          string   `json:"name" yaml:"name"`
+	PermittedTags []string `json:"permitted_tags" yaml:"permitted_tags"`
+	// Admin allows to use administration API such as audit log viewer
+	Admin bool `json:"admin" yaml:"admin"`
+	// RateLimit overrides default rate limit of each user having the role
+	RateLimit *rateLimit `json:"rate_limit,omitempty" yaml:"rate_limit"`
+	// Backends are names of Minerva backends the role can search. Empty
+	// means all backends.
+	Backends []string `json:"backends,omitempty" yaml:"backends"`
+	source   string
 }
 
+// authzRule assigns a role to users matched with UserRegex and/or belonging
+// to Group given by identity provider. If both are set, both must match.
 type authzRule struct {
-	UserRegex string `json:"user_regex"`
-	Role      string `json:"role"`
+	UserRegex string `json:"user_regex" yaml:"user_regex"`
+	Group     string `json:"group" yaml:"group"`
+	Role      string `json:"role" yaml:"role"`
 	regex     *regexp.Regexp
 	rolePtr   *authzRole
+	source    string
+}
+
+func (x *authzRule) label() string {
+	if x.Group == "" {
+		return x.UserRegex
+	}
+	if x.UserRegex == "" {
+		return "group:" + x.Group
+	}
+	return x.UserRegex + " & group:" + x.Group
+}
+
+func (x *authzRule) match(userID string, groups []string) bool {
+	if x.Group != "" {
+		found := false
+		for _, g := range groups {
+			if g == x.Group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+		if x.UserRegex == "" {
+			return true
+		}
+	}
+
+	return x.regex.MatchString(userID)
+}
+
+// authzTable is content of one authz file. Multiple tables are merged into
+// one authzService.
+type authzTable struct {
+	Users []*authzUser `json:"users" yaml:"users"`
+	Roles []*authzRole `json:"roles" yaml:"roles"`
+	Rules []*authzRule `json:"rules" yaml:"rules"`
 }
 
 type authzService struct {
@@ -37,76 +133,375 @@ type authzService struct {
 	Rules   []*authzRule `json:"rules"`
 	UserMap map[string]*authzUser
 	RoleMap map[string]*authzRole
+
+	// ruleCache keeps users resolved by rules. The key consists of user ID and
+	// groups because group rules depend on both.
+	ruleCache map[string]*authzUser
+	mutex     sync.Mutex
+}
+
+var authzFileExts = map[string]bool{
+	".json": true,
+	".yaml": true,
+	".yml":  true,
 }
 
-func newAuthzServiceFromFile(filePath string) (*authzService, error) {
-	raw, err := ioutil.ReadFile(filePath)
+// expandAuthzPath converts authz path to a list of files. The path can be a
+// single file, a directory (searched recursively) or a glob pattern.
+func expandAuthzPath(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid authz path pattern: %s", path)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("No authz file matches: %s", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Fail to load authz file: %s", filePath)
+		return nil, errors.Wrapf(err, "Fail to load authz file: %s", path)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && authzFileExts[strings.ToLower(filepath.Ext(p))] {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read authz directory: %s", path)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No authz file in directory: %s", path)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// newAuthzServiceFromPath loads and merges authz files specified by a file
+// path, a directory or a glob pattern. Both JSON and YAML are acceptable.
+func newAuthzServiceFromPath(path string) (*authzService, error) {
+	files, err := expandAuthzPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*authzTable
+	for _, filePath := range files {
+		raw, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to load authz file: %s", filePath)
+		}
+
+		table, err := parseAuthzTable(raw, filepath.Ext(filePath), filePath)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return buildAuthzService(tables)
+}
+
+// parseAuthzTable decodes raw data as YAML if ext is ".yaml" or ".yml",
+// otherwise as JSON. source is recorded to each entry for error messages.
+func parseAuthzTable(raw []byte, ext, source string) (*authzTable, error) {
+	var table authzTable
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &table); err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse authz yaml: %s", source)
+		}
+	default:
+		if err := json.Unmarshal(raw, &table); err != nil {
+			if source == "" {
+				return nil, errors.Wrapf(err, "Fail to parse authz data json: %s", string(raw))
+			}
+			return nil, errors.Wrapf(err, "Fail to parse authz json: %s", source)
+		}
+	}
+
+	for _, u := range table.Users {
+		u.source = source
+	}
+	for _, r := range table.Roles {
+		r.source = source
+	}
+	for _, r := range table.Rules {
+		r.source = source
 	}
 
-	return newAuthzService(raw)
+	return &table, nil
 }
 
 func newAuthzService(raw []byte) (*authzService, error) {
+	table, err := parseAuthzTable(raw, ".json", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return buildAuthzService([]*authzTable{table})
+}
+
+// inSources returns a suffix of error message describing where conflicting
+// entries come from. It returns empty string for data not loaded from file.
+func inSources(sources ...string) string {
+	var files []string
+	for _, src := range sources {
+		if src != "" {
+			files = append(files, src)
+		}
+	}
+
+	if len(files) == 0 {
+		return ""
+	}
+	return " (in " + strings.Join(files, ", ") + ")"
+}
+
+func buildAuthzService(tables []*authzTable) (*authzService, error) {
 	var srv authzService
 
-	if err := json.Unmarshal(raw, &srv); err != nil {
-		return nil, errors.Wrapf(err, "Fail to parse authz data json: %s", string(raw))
+	for _, table := range tables {
+		srv.Users = append(srv.Users, table.Users...)
+		srv.Roles = append(srv.Roles, table.Roles...)
+		srv.Rules = append(srv.Rules, table.Rules...)
 	}
 
 	srv.UserMap = map[string]*authzUser{}
 	srv.RoleMap = map[string]*authzRole{}
+	srv.ruleCache = map[string]*authzUser{}
 
 	for _, r := range srv.Roles {
-		if _, ok := srv.RoleMap[r.Name]; ok {
-			return nil, fmt.Errorf("Role '%s' is duplicated", r.Name)
+		if prev, ok := srv.RoleMap[r.Name]; ok {
+			return nil, fmt.Errorf("Role '%s' is duplicated%s", r.Name, inSources(prev.source, r.source))
 		}
 		srv.RoleMap[r.Name] = r
 	}
 
 	for _, u := range srv.Users {
-		if _, ok := srv.UserMap[u.UserID]; ok {
-			return nil, fmt.Errorf("User '%s' is duplicated", u.UserID)
+		if prev, ok := srv.UserMap[u.UserID]; ok {
+			return nil, fmt.Errorf("User '%s' is duplicated%s", u.UserID, inSources(prev.source, u.source))
 		}
 
 		role, ok := srv.RoleMap[u.Role]
 		if !ok {
-			return nil, fmt.Errorf("Role '%s' of User '%s' is not found", u.Role, u.UserID)
+			return nil, fmt.Errorf("Role '%s' of User '%s' is not found%s", u.Role, u.UserID, inSources(u.source))
 		}
 		u.rolePtr = role
+		u.matchedBy = "user"
 		srv.UserMap[u.UserID] = u
 	}
 
 	for _, rule := range srv.Rules {
 		role, ok := srv.RoleMap[rule.Role]
 		if !ok {
-			return nil, fmt.Errorf("Role '%s' of Rule '%s' is not found", rule.Role, rule.UserRegex)
+			return nil, fmt.Errorf("Role '%s' of Rule '%s' is not found%s", rule.Role, rule.label(), inSources(rule.source))
 		}
 		rule.rolePtr = role
 
 		ptn, err := regexp.Compile(rule.UserRegex)
 		if err != nil {
-			return nil, fmt.Errorf("Fail to compile regex of a rule: %s", rule.UserRegex)
+			return nil, fmt.Errorf("Fail to compile regex of a rule: %s%s", rule.UserRegex, inSources(rule.source))
 		}
 		rule.regex = ptn
 	}
 
-	logger.WithField("authz", srv).Info("Read authorization table")
+	logger.WithFields(logrus.Fields{
+		"users": len(srv.Users),
+		"roles": len(srv.Roles),
+		"rules": len(srv.Rules),
+	}).Info("Read authorization table")
 	return &srv, nil
 }
 
-func (x *authzService) lookup(userID string) *authzUser {
-	user, ok := x.UserMap[userID]
-	if !ok {
-		for _, rule := range x.Rules {
-			if rule.regex.MatchString(userID) {
-				newUser := &authzUser{UserID: userID, rolePtr: rule.rolePtr}
-				x.UserMap[userID] = newUser
-				return newUser
+// lookup resolves a user by user ID at first, then by rules with user ID and
+// groups of the user. It returns nil if the user is not authorized.
+func (x *authzService) lookup(userID string, groups []string) *authzUser {
+	if user, ok := x.UserMap[userID]; ok {
+		return user
+	}
+
+	sorted := append([]string{}, groups...)
+	sort.Strings(sorted)
+	key := strings.Join(append([]string{userID}, sorted...), "\n")
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if user, ok := x.ruleCache[key]; ok {
+		return user
+	}
+
+	for _, rule := range x.Rules {
+		if rule.match(userID, groups) {
+			newUser := &authzUser{
+				UserID:    userID,
+				Role:      rule.Role,
+				rolePtr:   rule.rolePtr,
+				matchedBy: "rule:" + rule.label(),
+			}
+			x.ruleCache[key] = newUser
+			return newUser
+		}
+	}
+
+	return nil
+}
+
+// mergeRoles builds a user having union of permitted tags and backends of
+// roles. A role without permitted tags (or backends) has no restriction, then
+// the merged one also has no restriction. It returns nil if none of roles is
+// found.
+func (x *authzService) mergeRoles(userID string, roleNames []string) *authzUser {
+	var found, tags, backends []string
+	var limit *rateLimit
+	unrestricted, allBackends, admin := false, false, false
+	seen := map[string]bool{}
+
+	for _, name := range roleNames {
+		role, ok := x.RoleMap[name]
+		if !ok {
+			logger.WithFields(logrus.Fields{
+				"user": userID,
+				"role": name,
+			}).Warn("Role of provisioned user is not found")
+			continue
+		}
+
+		found = append(found, name)
+		admin = admin || role.Admin
+		limit = limit.merge(role.RateLimit)
+		if len(role.PermittedTags) == 0 {
+			unrestricted = true
+		}
+		for _, tag := range role.PermittedTags {
+			if !seen[tag] {
+				tags = append(tags, tag)
+				seen[tag] = true
 			}
 		}
+
+		if len(role.Backends) == 0 {
+			allBackends = true
+		}
+		backends = append(backends, role.Backends...)
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+	if unrestricted {
+		tags = nil
+	}
+	if allBackends {
+		backends = nil
+	}
+
+	merged := &authzRole{
+		Name:          strings.Join(found, ","),
+		PermittedTags: tags,
+		Admin:         admin,
+		RateLimit:     limit,
+		Backends:      uniqueStrings(backends),
+	}
+	return &authzUser{
+		UserID:    userID,
+		Role:      merged.Name,
+		rolePtr:   merged,
+		roleNames: found,
+	}
+}
+
+// directoryEntry is a user provisioned by an external directory.
+type directoryEntry struct {
+	Active bool
+	Roles  []string
+	Groups []string
+}
+
+// authzDirectory provides users, roles and groups provisioned at runtime,
+// e.g. via SCIM. It's layered over the static authz table.
+type authzDirectory interface {
+	find(userID string) (*directoryEntry, bool)
+}
+
+var errAuthzUnavailable = fmt.Errorf("Authorization table is not available")
+
+// authzHolder keeps the current authzService. The service can be replaced
+// atomically while requests are served, e.g. by polling a remote source.
+type authzHolder struct {
+	srv        atomic.Pointer[authzService]
+	failed     atomic.Bool
+	failClosed bool
+	directory  authzDirectory
+}
+
+func newAuthzHolder(srv *authzService, failClosed bool) *authzHolder {
+	holder := &authzHolder{failClosed: failClosed}
+	holder.srv.Store(srv)
+	return holder
+}
+
+// get returns nil if the last refresh failed and failClosed is set. Callers
+// must reject the request in that case.
+func (x *authzHolder) get() *authzService {
+	if x.failClosed && x.failed.Load() {
+		return nil
+	}
+	return x.srv.Load()
+}
+
+func (x *authzHolder) set(srv *authzService) {
+	x.srv.Store(srv)
+	x.failed.Store(false)
+}
+
+func (x *authzHolder) setFailed(failed bool) {
+	x.failed.Store(failed)
+}
+
+// lookup resolves a user with the directory at first and the static authz
+// table after that. A user deactivated or deleted in the directory is
+// rejected even if the static table permits the user.
+func (x *authzHolder) lookup(userID string, groups []string) (*authzUser, error) {
+	srv := x.get()
+	if srv == nil {
+		return nil, errAuthzUnavailable
+	}
+
+	if x.directory == nil {
+		return srv.lookup(userID, groups), nil
+	}
+
+	entry, ok := x.directory.find(userID)
+	if !ok {
+		return srv.lookup(userID, groups), nil
+	}
+	if !entry.Active {
+		return nil, nil
+	}
+
+	if len(entry.Roles) > 0 {
+		if user := srv.mergeRoles(userID, entry.Roles); user != nil {
+			user.matchedBy = "directory"
+			return user, nil
+		}
 	}
 
-	return user
+	merged := append(append([]string{}, groups...), entry.Groups...)
+	return srv.lookup(userID, merged), nil
 }
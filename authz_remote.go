@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const authzRemoteMaxSize = 16 * 1024 * 1024
+
+// errAuthzSignature is returned if signature does not match the table.
+var errAuthzSignature = fmt.Errorf("Invalid signature of authz table")
+
+func isAuthzURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// authzRemote fetches authz table from HTTP(S) URL. It sends If-None-Match
+// with ETag of the last response and replaces authzService in holder only
+// when the table is changed.
+type authzRemote struct {
+	url    string
+	sigURL string
+	pubKey ed25519.PublicKey
+	client *http.Client
+	holder *authzHolder
+	etag   string
+}
+
+func newAuthzRemote(target, pubKeyPath string, holder *authzHolder) (*authzRemote, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse authz URL: %s", target)
+	}
+
+	remote := &authzRemote{
+		url:    target,
+		client: &http.Client{Timeout: 30 * time.Second},
+		holder: holder,
+	}
+
+	if pubKeyPath != "" {
+		pubKey, err := loadEd25519PublicKey(pubKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		remote.pubKey = pubKey
+
+		// Detached signature is served at "<path>.sig" next to the table
+		u.Path = u.Path + ".sig"
+		remote.sigURL = u.String()
+	}
+
+	return remote, nil
+}
+
+// loadEd25519PublicKey reads PEM encoded (PKIX) or base64 encoded raw
+// Ed25519 public key.
+func loadEd25519PublicKey(keyPath string) (ed25519.PublicKey, error) {
+	raw, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read authz public key: %s", keyPath)
+	}
+
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse authz public key: %s", keyPath)
+		}
+		pubKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Authz public key is not Ed25519: %s", keyPath)
+		}
+		return pubKey, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to decode authz public key: %s", keyPath)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid Ed25519 public key size %d: %s", len(decoded), keyPath)
+	}
+
+	return ed25519.PublicKey(decoded), nil
+}
+
+func (x *authzRemote) get(ctx context.Context, target string, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create request: %s", target)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to request: %s", target)
+	}
+
+	return resp, nil
+}
+
+// readLimited reads response body and returns error if it exceeds
+// authzRemoteMaxSize.
+func readLimited(resp *http.Response) ([]byte, error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, authzRemoteMaxSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read response: %s", resp.Request.URL)
+	}
+	if len(raw) > authzRemoteMaxSize {
+		return nil, fmt.Errorf("Response is larger than %d bytes: %s", authzRemoteMaxSize, resp.Request.URL)
+	}
+	return raw, nil
+}
+
+func (x *authzRemote) verify(ctx context.Context, raw []byte) error {
+	if x.pubKey == nil {
+		return nil
+	}
+
+	resp, err := x.get(ctx, x.sigURL, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fail to get authz signature: %s %d", x.sigURL, resp.StatusCode)
+	}
+
+	encoded, err := readLimited(resp)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return errors.Wrapf(err, "Fail to decode authz signature: %s", x.sigURL)
+	}
+
+	if !ed25519.Verify(x.pubKey, raw, sig) {
+		return fmt.Errorf("%w: %s", errAuthzSignature, x.url)
+	}
+
+	return nil
+}
+
+// authzFormatExt decides file type by Content-Type header or URL path.
+func authzFormatExt(resp *http.Response) string {
+	if strings.Contains(resp.Header.Get("Content-Type"), "yaml") {
+		return ".yaml"
+	}
+	return path.Ext(resp.Request.URL.Path)
+}
+
+// fetch gets authz table. It returns nil response if the table is not
+// modified since etag.
+func (x *authzRemote) fetch(ctx context.Context, etag string) (*http.Response, []byte, error) {
+	resp, err := x.get(ctx, x.url, etag)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil, nil
+	case http.StatusOK:
+	default:
+		return nil, nil, fmt.Errorf("Fail to get authz table: %s %d", x.url, resp.StatusCode)
+	}
+
+	raw, err := readLimited(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, raw, nil
+}
+
+// refresh fetches authz table and updates holder if the table is changed.
+func (x *authzRemote) refresh(ctx context.Context) error {
+	resp, raw, err := x.fetch(ctx, x.etag)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		x.holder.setFailed(false)
+		return nil
+	}
+
+	err = x.verify(ctx, raw)
+	if errors.Is(err, errAuthzSignature) {
+		// The table and the signature may be updated between fetching them,
+		// then both are fetched again once
+		logger.WithField("url", x.url).Warn("Signature does not match authz table, fetching again")
+		if resp, raw, err = x.fetch(ctx, ""); err == nil {
+			err = x.verify(ctx, raw)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	table, err := parseAuthzTable(raw, authzFormatExt(resp), x.url)
+	if err != nil {
+		return err
+	}
+
+	srv, err := buildAuthzService([]*authzTable{table})
+	if err != nil {
+		return err
+	}
+
+	x.holder.set(srv)
+	x.etag = resp.Header.Get("ETag")
+	logger.WithFields(logrus.Fields{
+		"url":  x.url,
+		"etag": x.etag,
+	}).Info("Updated authorization table")
+
+	return nil
+}
+
+// poll refreshes authz table every interval until ctx is cancelled. If
+// refresh fails, holder is marked as failed and it rejects all requests
+// when fail-closed mode. Otherwise the last good table is kept.
+func (x *authzRemote) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := x.refresh(ctx); err != nil {
+				logger.WithError(err).WithField("url", x.url).Error("Fail to refresh authorization table")
+				x.holder.setFailed(true)
+			}
+		}
+	}
+}
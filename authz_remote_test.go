@@ -0,0 +1,204 @@
+package main_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type authzTableServer struct {
+	mutex   sync.Mutex
+	table   string
+	etag    string
+	privKey ed25519.PrivateKey
+	fail    bool
+}
+
+func (x *authzTableServer) update(table, etag string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.table, x.etag = table, etag
+}
+
+func (x *authzTableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/authz.yaml":
+		if r.Header.Get("If-None-Match") == x.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", x.etag)
+		w.Write([]byte(x.table))
+	case "/authz.yaml.sig":
+		sig := ed25519.Sign(x.privKey, []byte(x.table))
+		w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+const remoteTableV1 = `
+roles:
+  - name: orange
+    permitted_tags: ["spell.1"]
+users:
+  - user_id: alpha@example.com
+    role: orange
+`
+
+const remoteTableV2 = `
+roles:
+  - name: orange
+    permitted_tags: ["spell.1"]
+users:
+  - user_id: bravo@example.com
+    role: orange
+`
+
+func TestAuthzRemote(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "authz.pub")
+	writeAuthzFile(t, keyPath, base64.StdEncoding.EncodeToString(pubKey))
+
+	srv := &authzTableServer{table: remoteTableV1, etag: `"v1"`, privKey: privKey}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	holder, err := main.SetupAuthz(ctx, main.Arguments{
+		AuthzFilePath:     ts.URL + "/authz.yaml",
+		AuthzPublicKey:    keyPath,
+		AuthzPollInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, main.AuthzHolderLookup(holder, "alpha@example.com"))
+
+	srv.update(remoteTableV2, `"v2"`)
+	assert.Eventually(t, func() bool {
+		return main.AuthzHolderLookup(holder, "bravo@example.com") != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, main.AuthzHolderLookup(holder, "alpha@example.com"))
+
+	// Table with invalid signature is not applied and the last good one is kept
+	srv.mutex.Lock()
+	srv.privKey = func() ed25519.PrivateKey {
+		_, other, _ := ed25519.GenerateKey(rand.Reader)
+		return other
+	}()
+	srv.mutex.Unlock()
+	srv.update(remoteTableV1, `"v3"`)
+	time.Sleep(50 * time.Millisecond)
+	assert.NotNil(t, main.AuthzHolderLookup(holder, "bravo@example.com"))
+	assert.Nil(t, main.AuthzHolderLookup(holder, "alpha@example.com"))
+}
+
+func TestAuthzRemoteFailClosed(t *testing.T) {
+	srv := &authzTableServer{table: remoteTableV1, etag: `"v1"`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	holder, err := main.SetupAuthz(ctx, main.Arguments{
+		AuthzFilePath:     ts.URL + "/authz.yaml",
+		AuthzPollInterval: 10 * time.Millisecond,
+		AuthzFailClosed:   true,
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, main.AuthzHolderLookup(holder, "alpha@example.com"))
+
+	srv.mutex.Lock()
+	srv.fail = true
+	srv.mutex.Unlock()
+	assert.Eventually(t, func() bool {
+		return main.AuthzHolderLookup(holder, "alpha@example.com") == nil
+	}, time.Second, 10*time.Millisecond)
+
+	srv.mutex.Lock()
+	srv.fail = false
+	srv.mutex.Unlock()
+	assert.Eventually(t, func() bool {
+		return main.AuthzHolderLookup(holder, "alpha@example.com") != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAuthzRemoteSignatureRace(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "authz.pub")
+	writeAuthzFile(t, keyPath, base64.StdEncoding.EncodeToString(pubKey))
+
+	// Table is updated to v2 after the first fetch of the table and before
+	// the fetch of the signature
+	var mutex sync.Mutex
+	fetched := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch r.URL.Path {
+		case "/authz.yaml":
+			fetched++
+			if fetched == 1 {
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte(remoteTableV1))
+				return
+			}
+			w.Header().Set("ETag", `"v2"`)
+			w.Write([]byte(remoteTableV2))
+		case "/authz.yaml.sig":
+			sig := ed25519.Sign(privKey, []byte(remoteTableV2))
+			w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	holder, err := main.SetupAuthz(context.Background(), main.Arguments{
+		AuthzFilePath:  ts.URL + "/authz.yaml",
+		AuthzPublicKey: keyPath,
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, main.AuthzHolderLookup(holder, "bravo@example.com"))
+	assert.Nil(t, main.AuthzHolderLookup(holder, "alpha@example.com"))
+	assert.Equal(t, 2, fetched)
+}
+
+func TestAuthzRemoteTooLarge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(remoteTableV1))
+		w.Write([]byte("#" + strings.Repeat("x", 16*1024*1024) + "\n"))
+	}))
+	defer ts.Close()
+
+	_, err := main.SetupAuthz(context.Background(), main.Arguments{
+		AuthzFilePath: ts.URL + "/authz.yaml",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Response is larger than")
+}
@@ -1,6 +1,9 @@
 package main_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	main "github.com/m-mizutani/strix"
@@ -153,3 +156,114 @@ func TestAuthzServiceRuleInavlidRegex(t *testing.T) {
 	_, err := main.NewAuthzService([]byte(raw))
 	assert.EqualError(t, err, "Fail to compile regex of a rule: ^[delta@")
 }
+
+func writeAuthzFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestAuthzServiceFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeAuthzFile(t, filepath.Join(dir, "roles.yaml"), `
+roles:
+  - name: blue
+    permitted_tags: []
+  - name: orange
+    permitted_tags: ["spell.1"]
+rules:
+  - user_regex: "@example.com$"
+    role: blue
+`)
+	writeAuthzFile(t, filepath.Join(dir, "users", "team-a.yml"), `
+users:
+  - user_id: alpha@example.com
+    role: orange
+`)
+	writeAuthzFile(t, filepath.Join(dir, "users", "team-b.json"), `{
+		"users": [{"user_id": "bravo@example.com", "role":"orange"}]
+	}`)
+
+	authz, err := main.NewAuthzServiceFromPath(dir)
+	require.NoError(t, err)
+
+	userA := main.AuthzServiceLookup(authz, "alpha@example.com")
+	require.NotNil(t, userA)
+	assert.Contains(t, main.AuthzUserAllowed(userA), "spell.1")
+
+	userB := main.AuthzServiceLookup(authz, "bravo@example.com")
+	require.NotNil(t, userB)
+	assert.Contains(t, main.AuthzUserAllowed(userB), "spell.1")
+
+	userC := main.AuthzServiceLookup(authz, "charlie@example.com")
+	require.NotNil(t, userC)
+	assert.Equal(t, 0, len(main.AuthzUserAllowed(userC)))
+
+	// Glob pattern selects only matched files
+	_, err = main.NewAuthzServiceFromPath(filepath.Join(dir, "users", "*.yml"))
+	assert.EqualError(t, err, "Role 'orange' of User 'alpha@example.com' is not found (in "+
+		filepath.Join(dir, "users", "team-a.yml")+")")
+}
+
+func TestAuthzServiceFromPathDuplicatedUser(t *testing.T) {
+	dir := t.TempDir()
+	fileA := filepath.Join(dir, "a.yaml")
+	fileB := filepath.Join(dir, "b.yaml")
+	writeAuthzFile(t, fileA, `
+roles:
+  - name: blue
+users:
+  - user_id: alpha@example.com
+    role: blue
+`)
+	writeAuthzFile(t, fileB, `
+users:
+  - user_id: alpha@example.com
+    role: blue
+`)
+
+	_, err := main.NewAuthzServiceFromPath(dir)
+	assert.EqualError(t, err, "User 'alpha@example.com' is duplicated (in "+fileA+", "+fileB+")")
+}
+
+func TestAuthzServiceGroupRule(t *testing.T) {
+	raw := `{
+		"users": [
+			{"user_id": "alpha@example.com", "role":"blue"}
+		],
+		"roles": [
+			{"name":"blue", "permitted_tags":[]},
+			{"name":"orange", "permitted_tags":["spell.1"]},
+			{"name":"green", "permitted_tags":["spell.2"]}
+		],
+		"rules": [
+			{"group":"incident-response", "user_regex":"@example.com$", "role":"blue"},
+			{"group":"sre", "role":"green"},
+			{"user_regex":"@example.com$", "role":"orange"}
+		]
+	}`
+
+	authz, err := main.NewAuthzService([]byte(raw))
+	require.NoError(t, err)
+
+	// User entry has priority over group rules
+	userA := main.AuthzServiceLookupWithGroups(authz, "alpha@example.com", []string{"sre"})
+	require.NotNil(t, userA)
+	assert.Equal(t, 0, len(main.AuthzUserAllowed(userA)))
+
+	// Both group and user_regex must match
+	userB1 := main.AuthzServiceLookupWithGroups(authz, "bravo@example.com", []string{"incident-response"})
+	require.NotNil(t, userB1)
+	assert.Equal(t, 0, len(main.AuthzUserAllowed(userB1)))
+	userB2 := main.AuthzServiceLookupWithGroups(authz, "bravo@example.org", []string{"incident-response"})
+	assert.Nil(t, userB2)
+
+	// Group only rule
+	userC := main.AuthzServiceLookupWithGroups(authz, "charlie@example.org", []string{"dev", "sre"})
+	require.NotNil(t, userC)
+	assert.Contains(t, main.AuthzUserAllowed(userC), "spell.2")
+
+	// Changed groups are not affected by previous lookup
+	userB3 := main.AuthzServiceLookupWithGroups(authz, "bravo@example.com", nil)
+	require.NotNil(t, userB3)
+	assert.Contains(t, main.AuthzUserAllowed(userB3), "spell.1")
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultBackendName = "default"
+
+	// backendSeparator joins backend name and search ID of the backend,
+	// e.g. "tokyo.0d5c1b2e-...".
+	backendSeparator = "."
+)
+
+var backendNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var (
+	errBackendNotFound  = errors.New("Backend is not found")
+	errBackendForbidden = errors.New("Backend is not permitted")
+)
+
+// minervaBackend is a deployment of Minerva. Requests are authenticated by
+// API key given directly, by an environment variable or by a file reloaded on
+// change, or signed with SigV4 if Auth is "sigv4".
+type minervaBackend struct {
+	Name       string `json:"name" yaml:"name"`
+	Endpoint   string `json:"endpoint" yaml:"endpoint"`
+	APIKey     string `json:"api_key" yaml:"api_key"`
+	APIKeyEnv  string `json:"api_key_env" yaml:"api_key_env"`
+	APIKeyFile string `json:"api_key_file" yaml:"api_key_file"`
+	Default    bool   `json:"default" yaml:"default"`
+
+	// SigV4 signing options. Region is taken from AWS config if not set.
+	Auth    string `json:"auth" yaml:"auth"`
+	Region  string `json:"region" yaml:"region"`
+	Service string `json:"service" yaml:"service"`
+	RoleARN string `json:"role_arn" yaml:"role_arn"`
+
+	// Connection options, e.g. private CA and client certificate
+	TLS   *upstreamTLS `json:"tls" yaml:"tls"`
+	Proxy string       `json:"proxy" yaml:"proxy"`
+
+	url *url.URL
+
+	upstream  upstreamConfig
+	transport http.RoundTripper
+	breaker   *circuitBreaker
+	apiKeys   *apiKeyStore
+}
+
+// direct sets destination of the backend to req. path is path of Minerva
+// API, e.g. /api/v1/search. API key or signature is set by transport of the
+// backend.
+func (x *minervaBackend) direct(req *http.Request, path string) {
+	req.URL.Host = x.url.Host
+	req.URL.Scheme = x.url.Scheme
+	req.URL.Path = x.url.Path + path
+	req.URL.RawPath = ""
+	req.Host = x.url.Host
+	req.Header.Del("x-api-key")
+}
+
+// roundTrip sends req to the backend with timeouts, retries and circuit
+// breaker of the backend.
+func (x *minervaBackend) roundTrip(req *http.Request) (*http.Response, error) {
+	return sendUpstream(x.transport, x.breaker, x.upstream, x.Name, req)
+}
+
+// backendRoute selects backend of a new search. Tags are patterns of
+// path.Match and matched with requested tags. If both Tags and Role are set,
+// both must match.
+type backendRoute struct {
+	Tags    []string `json:"tags" yaml:"tags"`
+	Role    string   `json:"role" yaml:"role"`
+	Backend string   `json:"backend" yaml:"backend"`
+}
+
+func (x *backendRoute) match(user *authzUser, tags []string) bool {
+	if x.Role != "" && !containsString(user.roles(), x.Role) {
+		return false
+	}
+
+	if len(x.Tags) > 0 {
+		for _, tag := range tags {
+			for _, pattern := range x.Tags {
+				if ok, _ := path.Match(pattern, tag); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+type backendConfig struct {
+	Backends []*minervaBackend `json:"backends" yaml:"backends"`
+	Routes   []*backendRoute   `json:"routes" yaml:"routes"`
+
+	// Upstream is given by arguments and applied to all backends
+	Upstream upstreamConfig `json:"-" yaml:"-"`
+}
+
+func loadBackendConfig(filePath string) (*backendConfig, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read backend config: %s", filePath)
+	}
+
+	var config backendConfig
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &config)
+	default:
+		err = json.Unmarshal(raw, &config)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse backend config: %s", filePath)
+	}
+
+	return &config, nil
+}
+
+// backendRouter selects a backend of a search. Search IDs returned to clients
+// have the backend name as prefix if multiple backends are configured, so
+// that following requests of the search reach the same backend.
+type backendRouter struct {
+	backends       []*minervaBackend
+	byName         map[string]*minervaBackend
+	routes         []*backendRoute
+	defaultBackend *minervaBackend
+}
+
+func newBackendRouter(config *backendConfig) (*backendRouter, error) {
+	router := &backendRouter{
+		backends: config.Backends,
+		byName:   map[string]*minervaBackend{},
+		routes:   config.Routes,
+	}
+
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("No Minerva backend is configured")
+	}
+
+	for _, b := range config.Backends {
+		if !backendNamePattern.MatchString(b.Name) || b.Name == federatedBackendName {
+			return nil, fmt.Errorf("Invalid backend name: '%s'", b.Name)
+		}
+		if _, ok := router.byName[b.Name]; ok {
+			return nil, fmt.Errorf("Duplicated backend name: %s", b.Name)
+		}
+
+		u, err := url.Parse(b.Endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid endpoint of backend %s: '%s'", b.Name, b.Endpoint)
+		}
+		b.url = u
+		b.upstream = config.Upstream
+		transport := newUpstreamTransport(config.Upstream)
+		if err := b.configureTransport(transport); err != nil {
+			return nil, err
+		}
+		b.transport = transport
+		b.breaker = newCircuitBreaker(b.Name, config.Upstream.BreakerFailures, config.Upstream.BreakerCooldown)
+
+		switch b.Auth {
+		case "", upstreamAuthAPIKey:
+			b.Auth = upstreamAuthAPIKey
+			if b.APIKeyFile != "" {
+				store, err := newFileAPIKeyStore(b.Name, b.APIKeyFile)
+				if err != nil {
+					return nil, err
+				}
+				b.apiKeys = store
+			} else {
+				if b.APIKeyEnv != "" {
+					b.APIKey = os.Getenv(b.APIKeyEnv)
+				}
+				if b.APIKey == "" {
+					return nil, fmt.Errorf("API key of backend %s is not set", b.Name)
+				}
+				b.apiKeys = newStaticAPIKeyStore(b.Name, b.APIKey)
+			}
+			b.transport = &apiKeyTransport{base: b.transport, store: b.apiKeys}
+
+		case upstreamAuthSigV4:
+			creds, region, err := newSigV4Credentials(context.Background(), b.Region, b.RoleARN)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Fail to setup SigV4 of backend %s", b.Name)
+			}
+			b.Region = region
+			b.transport = newSigV4Transport(b.transport, creds, region, b.Service)
+
+		default:
+			return nil, fmt.Errorf("Invalid auth of backend %s: '%s'", b.Name, b.Auth)
+		}
+		b.transport = &tracingTransport{base: b.transport, backend: b.Name}
+
+		if b.Default {
+			if router.defaultBackend != nil {
+				return nil, fmt.Errorf("Multiple default backends: %s and %s", router.defaultBackend.Name, b.Name)
+			}
+			router.defaultBackend = b
+		}
+		router.byName[b.Name] = b
+
+		fields := logrus.Fields{
+			"name":   b.Name,
+			"target": b.Endpoint,
+			"auth":   b.Auth,
+		}
+		if b.Auth == upstreamAuthSigV4 {
+			fields["region"] = b.Region
+			fields["role_arn"] = b.RoleARN
+		} else {
+			primary, secondary := b.apiKeys.keys()
+			fields["apikey"] = apiKeyFingerprint(primary)
+			if secondary != "" {
+				fields["secondary_apikey"] = apiKeyFingerprint(secondary)
+			}
+		}
+		logger.WithFields(fields).Info("build proxy")
+	}
+
+	if router.defaultBackend == nil {
+		router.defaultBackend = config.Backends[0]
+	}
+
+	for _, r := range config.Routes {
+		if _, ok := router.byName[r.Backend]; !ok {
+			return nil, fmt.Errorf("Backend of route is not found: '%s'", r.Backend)
+		}
+		for _, pattern := range r.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "Invalid tag pattern of route to %s: %s", r.Backend, pattern)
+			}
+		}
+	}
+
+	return router, nil
+}
+
+// setupBackends builds backends from a config file and/or the endpoint given
+// by argument. The endpoint is added as "default" backend.
+func setupBackends(args arguments) (*backendRouter, error) {
+	config := &backendConfig{}
+	if args.BackendsPath != "" {
+		loaded, err := loadBackendConfig(args.BackendsPath)
+		if err != nil {
+			return nil, err
+		}
+		config = loaded
+	}
+
+	config.Upstream = upstreamConfig{
+		DialTimeout:           args.UpstreamDialTimeout,
+		ResponseHeaderTimeout: args.UpstreamHeaderTimeout,
+		Timeout:               args.UpstreamTimeout,
+		Retries:               args.UpstreamRetries,
+		RetryBackoff:          args.UpstreamRetryBackoff,
+		BreakerFailures:       args.CircuitBreakerFailures,
+		BreakerCooldown:       args.CircuitBreakerCooldown,
+	}
+
+	if args.Endpoint != "" {
+		config.Backends = append(config.Backends, &minervaBackend{
+			Name:       defaultBackendName,
+			Endpoint:   args.Endpoint,
+			APIKey:     args.APIKey,
+			APIKeyFile: args.APIKeyFile,
+			Auth:       args.UpstreamAuth,
+			Region:     args.AWSRegion,
+			RoleARN:    args.AWSRoleARN,
+			TLS:        args.upstreamTLS(),
+			Proxy:      args.UpstreamProxy,
+		})
+	}
+
+	router, err := newBackendRouter(config)
+	if err != nil {
+		return nil, err
+	}
+	router.watchAPIKeys(context.Background(), args.APIKeyReloadInterval)
+
+	return router, nil
+}
+
+// watchAPIKeys starts reloading API key files of backends in background.
+func (x *backendRouter) watchAPIKeys(ctx context.Context, interval time.Duration) {
+	for _, b := range x.backends {
+		if b.apiKeys != nil && b.apiKeys.path != "" {
+			go b.apiKeys.watch(ctx, interval)
+		}
+	}
+}
+
+func (x *backendRouter) prefixed() bool {
+	return len(x.backends) > 1
+}
+
+func (x *backendRouter) permitted(user *authzUser, b *minervaBackend) bool {
+	names := user.permittedBackends()
+	return len(names) == 0 || containsString(names, b.Name)
+}
+
+// available returns backends the user can search.
+func (x *backendRouter) available(user *authzUser) []*minervaBackend {
+	var backends []*minervaBackend
+	for _, b := range x.backends {
+		if x.permitted(user, b) {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// route selects a backend of a new search. A backend explicitly selected by
+// client is used at first, then the first matched route and the default
+// backend. If the default backend is not permitted, the first permitted one
+// is used.
+func (x *backendRouter) route(user *authzUser, selector string, tags []string) (*minervaBackend, error) {
+	if selector != "" {
+		b, ok := x.byName[selector]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errBackendNotFound, selector)
+		}
+		if !x.permitted(user, b) {
+			return nil, fmt.Errorf("%w: %s", errBackendForbidden, selector)
+		}
+		return b, nil
+	}
+
+	for _, r := range x.routes {
+		b := x.byName[r.Backend]
+		if r.match(user, tags) && x.permitted(user, b) {
+			return b, nil
+		}
+	}
+
+	if x.permitted(user, x.defaultBackend) {
+		return x.defaultBackend, nil
+	}
+	if backends := x.available(user); len(backends) > 0 {
+		return backends[0], nil
+	}
+
+	return nil, errBackendForbidden
+}
+
+// resolve returns backend and search ID of the backend from search ID given
+// by client. A search ID without known backend name belongs to the default
+// backend.
+func (x *backendRouter) resolve(user *authzUser, searchID string) (*minervaBackend, string, error) {
+	b, rawID := x.defaultBackend, searchID
+	if idx := strings.Index(searchID, backendSeparator); idx > 0 {
+		if named, ok := x.byName[searchID[:idx]]; ok {
+			b, rawID = named, searchID[idx+1:]
+		}
+	}
+
+	if !x.permitted(user, b) {
+		return nil, "", fmt.Errorf("%w: %s", errBackendForbidden, b.Name)
+	}
+	return b, rawID, nil
+}
+
+// searchID returns search ID for client.
+func (x *backendRouter) searchID(b *minervaBackend, rawID string) string {
+	if !x.prefixed() {
+		return rawID
+	}
+	return b.Name + backendSeparator + rawID
+}
+
+// requestedTags returns tags to route a new search. "tags" parameter is
+// used if given, otherwise permitted tags of the user.
+func requestedTags(tagsParam string, user *authzUser) []string {
+	if tagsParam != "" {
+		return strings.Split(tagsParam, ",")
+	}
+	return user.permitted()
+}
+
+// rewriteSearchID replaces search_id in a response of search creation. The
+// response is decompressed to rewrite it.
+func rewriteSearchID(resp *http.Response, rewrite func(id string) string) error {
+	if resp.StatusCode >= 300 {
+		return nil
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "Fail to read response of search creation")
+	}
+
+	body, err := decodeContent(bytes.NewReader(raw), resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return errors.Wrap(err, "Fail to decode response of search creation")
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&data); err != nil {
+		return errors.Wrap(err, "Fail to parse response of search creation")
+	}
+	if id, ok := data["search_id"].(string); ok {
+		data["search_id"] = rewrite(id)
+	}
+
+	rewritten, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal response of search creation")
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	resp.Header.Del("Content-Encoding")
+	return nil
+}
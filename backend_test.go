@@ -0,0 +1,81 @@
+package main_test
+
+import (
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendRouter(t *testing.T) {
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [
+			{"name": "analyst", "permitted_tags": ["jp.web", "eu.web"]},
+			{"name": "eu-analyst", "permitted_tags": ["eu.web"], "backends": ["frankfurt"]},
+			{"name": "bu", "permitted_tags": ["payment"]}
+		],
+		"users": [
+			{"user_id": "blue@example.com", "role": "analyst"},
+			{"user_id": "orange@example.com", "role": "eu-analyst"},
+			{"user_id": "green@example.com", "role": "bu"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: "https://tokyo.example.com/prod", APIKey: "tokyo-key"},
+			{Name: "frankfurt", Endpoint: "https://frankfurt.example.com/prod", APIKey: "frankfurt-key"},
+			{Name: "payment", Endpoint: "https://payment.example.com/prod", APIKey: "payment-key"},
+		},
+		Routes: []*main.BackendRoute{
+			{Tags: []string{"eu.*"}, Backend: "frankfurt"},
+			{Role: "bu", Backend: "payment"},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("route", func(t *testing.T) {
+		cases := []struct {
+			user, selector string
+			tags           []string
+			expect         string
+		}{
+			{"blue@example.com", "", []string{"jp.web"}, "tokyo"},
+			{"blue@example.com", "", []string{"eu.web"}, "frankfurt"},
+			{"blue@example.com", "payment", nil, "payment"},
+			{"orange@example.com", "", []string{"jp.web"}, "frankfurt"},
+			{"green@example.com", "", nil, "payment"},
+		}
+		for _, c := range cases {
+			name, err := main.BackendRouteOf(router, srv, c.user, c.selector, c.tags)
+			require.NoError(t, err)
+			assert.Equal(t, c.expect, name, c)
+		}
+
+		_, err := main.BackendRouteOf(router, srv, "orange@example.com", "tokyo", nil)
+		assert.Error(t, err)
+		_, err = main.BackendRouteOf(router, srv, "blue@example.com", "osaka", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("search ID", func(t *testing.T) {
+		id := main.BackendSearchID(router, "frankfurt", "0d5c1b2e")
+		assert.Equal(t, "frankfurt.0d5c1b2e", id)
+
+		name, rawID, err := main.BackendResolve(router, srv, "orange@example.com", id)
+		require.NoError(t, err)
+		assert.Equal(t, "frankfurt", name)
+		assert.Equal(t, "0d5c1b2e", rawID)
+
+		// Search ID without backend goes to the default backend
+		name, rawID, err = main.BackendResolve(router, srv, "blue@example.com", "0d5c1b2e")
+		require.NoError(t, err)
+		assert.Equal(t, "tokyo", name)
+		assert.Equal(t, "0d5c1b2e", rawID)
+
+		_, _, err = main.BackendResolve(router, srv, "orange@example.com", "tokyo.0d5c1b2e")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheShared = "shared"
+	cacheDedup  = "dedup"
+	cacheBypass = "bypass"
+
+	searchStatusSucceeded = "SUCCEEDED"
+)
+
+// cachedResponse is an upstream response kept in memory. It must not be
+// modified after creation because it's shared by requests.
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (x *cachedResponse) size() int64 {
+	return int64(len(x.body))
+}
+
+func (x *cachedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range x.header {
+		w.Header()[k] = append([]string{}, v...)
+	}
+	w.WriteHeader(x.status)
+	w.Write(x.body)
+}
+
+// searchStatus returns metadata.status of a response of search status.
+func (x *cachedResponse) searchStatus() string {
+	body, err := decodeContent(bytes.NewReader(x.body), x.header.Get("Content-Encoding"))
+	if err != nil {
+		return ""
+	}
+
+	var resp struct {
+		Metadata struct {
+			Status string `json:"status"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return ""
+	}
+	return resp.Metadata.Status
+}
+
+// responseBuffer is http.ResponseWriter to record an upstream response.
+type responseBuffer struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{status: http.StatusOK, header: http.Header{}}
+}
+
+func (x *responseBuffer) Header() http.Header         { return x.header }
+func (x *responseBuffer) WriteHeader(status int)      { x.status = status }
+func (x *responseBuffer) Write(b []byte) (int, error) { return x.body.Write(b) }
+
+func (x *responseBuffer) response() *cachedResponse {
+	return &cachedResponse{
+		status: x.status,
+		header: x.header.Clone(),
+		body:   x.body.Bytes(),
+	}
+}
+
+type cacheEntry struct {
+	key       string
+	resp      *cachedResponse
+	expiresAt time.Time
+}
+
+// responseCache keeps responses of completed searches with TTL and total
+// size limit, evicting the least recently used one. Identical requests of
+// cacheable responses in flight share one upstream call.
+type responseCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List
+	size      int64
+	completed map[string]time.Time
+
+	group singleflight.Group
+}
+
+func newResponseCache(ttl time.Duration, maxBytes int64) *responseCache {
+	return &responseCache{
+		ttl:       ttl,
+		maxBytes:  maxBytes,
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+		completed: map[string]time.Time{},
+	}
+}
+
+// responseCacheKey identifies a response by path including search ID, query
+// string and permitted tags because Minerva filters logs by the tags. Accept
+// encoding is also a part of the key not to send gzip to a client not
+// accepting it.
+func responseCacheKey(req *http.Request, permittedTags []string) string {
+	tags := append([]string{}, permittedTags...)
+	sort.Strings(tags)
+
+	encoding := ""
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		encoding = "gzip"
+	}
+
+	return strings.Join([]string{req.URL.Path, req.URL.RawQuery, strings.Join(tags, ","), encoding}, "\n")
+}
+
+func (x *responseCache) enabled() bool {
+	return x.ttl > 0 && x.maxBytes > 0
+}
+
+func (x *responseCache) get(key string, now time.Time) *cachedResponse {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	elem, ok := x.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if now.After(entry.expiresAt) {
+		x.remove(elem)
+		return nil
+	}
+
+	x.lru.MoveToFront(elem)
+	return entry.resp
+}
+
+func (x *responseCache) put(key string, resp *cachedResponse, now time.Time) {
+	if resp.size() > x.maxBytes {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if elem, ok := x.entries[key]; ok {
+		x.remove(elem)
+	}
+
+	for x.size+resp.size() > x.maxBytes {
+		x.remove(x.lru.Back())
+	}
+
+	x.entries[key] = x.lru.PushFront(&cacheEntry{
+		key:       key,
+		resp:      resp,
+		expiresAt: now.Add(x.ttl),
+	})
+	x.size += resp.size()
+}
+
+// remove deletes an entry. Caller must hold the lock.
+func (x *responseCache) remove(elem *list.Element) {
+	entry := x.lru.Remove(elem).(*cacheEntry)
+	delete(x.entries, entry.key)
+	x.size -= entry.resp.size()
+}
+
+// markCompleted records that the search is completed and results of the
+// search can be cached.
+func (x *responseCache) markCompleted(searchID string, now time.Time) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for id, expiresAt := range x.completed {
+		if now.After(expiresAt) {
+			delete(x.completed, id)
+		}
+	}
+	x.completed[searchID] = now.Add(x.ttl)
+}
+
+func (x *responseCache) isCompleted(searchID string, now time.Time) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	expiresAt, ok := x.completed[searchID]
+	return ok && !now.After(expiresAt)
+}
+
+// cacheable returns true if a response of the request may be cached, i.e.
+// cache is enabled and it's search status or logs and timeseries of a
+// completed search. Other responses are streamed without buffering.
+func (x *responseCache) cacheable(searchID string, isStatus bool) bool {
+	return x.enabled() && (isStatus || x.isCompleted(searchID, time.Now()))
+}
+
+// do returns a cached response or calls fetch. Concurrent calls with the
+// same key share a result of fetch. A successful response is cached if the
+// search is completed, i.e. status of the search is SUCCEEDED or logs and
+// timeseries of a search already known as completed. A partial response of
+// federated search is not cached.
+func (x *responseCache) do(key, searchID string, isStatus bool, fetch func() *cachedResponse) (*cachedResponse, string) {
+	if x.enabled() {
+		if resp := x.get(key, time.Now()); resp != nil {
+			return resp, cacheHit
+		}
+	}
+
+	v, _, shared := x.group.Do(key, func() (interface{}, error) {
+		resp := fetch()
+		if !x.enabled() || resp.status != http.StatusOK || resp.header.Get(partialHeader) != "" {
+			return resp, nil
+		}
+
+		now := time.Now()
+		if isStatus {
+			if resp.searchStatus() != searchStatusSucceeded {
+				return resp, nil
+			}
+			x.markCompleted(searchID, now)
+		} else if !x.isCompleted(searchID, now) {
+			return resp, nil
+		}
+
+		x.put(key, resp, now)
+		return resp, nil
+	})
+
+	if shared {
+		return v.(*cachedResponse), cacheShared
+	}
+	return v.(*cachedResponse), cacheMiss
+}
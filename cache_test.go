@@ -0,0 +1,118 @@
+package main_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := main.NewResponseCache(time.Minute, 64)
+	calls := 0
+	fetch := func(body string) func() string {
+		return func() string {
+			calls++
+			return body
+		}
+	}
+
+	// Logs of a search not known as completed are not cached
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1/logs", "s1", false, fetch(`{"logs":[]}`)))
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1/logs", "s1", false, fetch(`{"logs":[]}`)))
+	assert.Equal(t, 2, calls)
+
+	// Running search is not cached
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1", "s1", true, fetch(`{"metadata":{"status":"RUNNING"}}`)))
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1", "s1", true, fetch(`{"metadata":{"status":"SUCCEEDED"}}`)))
+	assert.Equal(t, "hit", main.ResponseCacheDo(cache, "s1", "s1", true, fetch(`{"metadata":{"status":"SUCCEEDED"}}`)))
+	assert.Equal(t, 4, calls)
+
+	// Logs of the completed search are cached
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1/logs", "s1", false, fetch(`{"logs":[]}`)))
+	assert.Equal(t, "hit", main.ResponseCacheDo(cache, "s1/logs", "s1", false, fetch(`{"logs":[]}`)))
+	assert.Equal(t, 5, calls)
+
+	// Least recently used entry is evicted by size limit
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1/logs?offset=50", "s1", false, fetch(`{"logs":[{"tag":"a","log":{}}]}`)))
+	assert.Equal(t, "hit", main.ResponseCacheDo(cache, "s1/logs", "s1", false, fetch(`{"logs":[]}`)))
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1", "s1", true, fetch(`{"metadata":{"status":"SUCCEEDED"}}`)))
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	cache := main.NewResponseCache(0, 64)
+	calls := 0
+	fetch := func() string {
+		calls++
+		return `{"metadata":{"status":"SUCCEEDED"}}`
+	}
+
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1", "s1", true, fetch))
+	assert.Equal(t, "miss", main.ResponseCacheDo(cache, "s1", "s1", true, fetch))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponseCacheBypassStreams(t *testing.T) {
+	for name, ttl := range map[string]time.Duration{
+		"disabled":            0,
+		"search not complete": time.Minute,
+	} {
+		ttl := ttl
+		t.Run(name, func(t *testing.T) {
+			canceled := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"logs":[`))
+				w.(http.Flusher).Flush()
+
+				select {
+				case <-r.Context().Done():
+					close(canceled)
+				case <-time.After(5 * time.Second):
+				}
+			}))
+			defer upstream.Close()
+
+			router, err := main.NewBackendRouter(&main.BackendConfig{
+				Backends: []*main.MinervaBackend{
+					{Name: "tokyo", Endpoint: upstream.URL, APIKey: "tokyo-key"},
+				},
+			})
+			require.NoError(t, err)
+			srv, err := main.NewAuthzService([]byte(`{
+				"roles": [{"name": "analyst", "permitted_tags": ["web"]}],
+				"users": [{"user_id": "blue@example.com", "role": "analyst"}]
+			}`))
+			require.NoError(t, err)
+
+			s := httptest.NewServer(main.NewProxyServer(main.NewAuthzHolder(srv, false), router, main.NewResponseCache(ttl, 1<<20)))
+			defer s.Close()
+
+			req, err := http.NewRequest(http.MethodGet, s.URL+"/api/v1/search/s1/logs", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-User", "blue@example.com")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			assert.Equal(t, "bypass", resp.Header.Get("X-Strix-Cache"))
+
+			// The first chunk arrives before the upstream response completes
+			buf := make([]byte, 9)
+			_, err = io.ReadFull(resp.Body, buf)
+			require.NoError(t, err)
+			assert.Equal(t, `{"logs":[`, string(buf))
+
+			// Client leaving cancels the upstream request
+			resp.Body.Close()
+			select {
+			case <-canceled:
+			case <-time.After(3 * time.Second):
+				t.Fatal("upstream request is not canceled")
+			}
+		})
+	}
+}
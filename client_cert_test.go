@@ -0,0 +1,100 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueClientCert returns a key pair of client certificate having subject
+// and email addresses signed by the CA.
+func issueClientCert(t *testing.T, ca *testCA, subject pkix.Name, emails []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        subject,
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, ca.pem, 0600))
+
+	cert, key := ca.issue(t, "strix.example.com", x509.ExtKeyUsageServerAuth)
+	require.NoError(t, ioutil.WriteFile(certFile, cert, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, key, 0600))
+
+	config, err := main.NewServerTLSConfig(main.Arguments{
+		TLSCert:       certFile,
+		TLSKey:        keyFile,
+		TLSClientAuth: "optional",
+		TLSClientCA:   caFile,
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, groups := main.ClientCertUser(r)
+		w.Write([]byte(userID + " " + strings.Join(groups, ",")))
+	}))
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	get := func(certs []tls.Certificate) string {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "strix.example.com", Certificates: certs},
+		}}
+		resp, err := client.Get(srv.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("email address is user ID and organizational units are groups", func(t *testing.T) {
+		pair := issueClientCert(t, ca, pkix.Name{CommonName: "blue", OrganizationalUnit: []string{"security"}}, []string{"blue@example.com"})
+		assert.Equal(t, "blue@example.com security", get([]tls.Certificate{pair}))
+	})
+
+	t.Run("common name is user ID without email address", func(t *testing.T) {
+		pair := issueClientCert(t, ca, pkix.Name{CommonName: "orange"}, nil)
+		assert.Equal(t, "orange ", get([]tls.Certificate{pair}))
+	})
+
+	t.Run("no identity without client certificate", func(t *testing.T) {
+		assert.Equal(t, " ", get(nil))
+	})
+}
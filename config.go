@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of option values. An option is taken from the first available one
+// of flag, environment variable, config file and default value.
+const (
+	configSourceFlag    = "flag"
+	configSourceEnv     = "env"
+	configSourceFile    = "file"
+	configSourceDefault = "default"
+)
+
+// configFileOption is the flag of config file path. It can not be set in the
+// config file itself.
+const configFileOption = "config"
+
+const redactedValue = "REDACTED"
+
+// secretOptions are redacted by "config print". Webhook and resolver URLs
+// often have a token in the path. Userinfo and query of other URLs are
+// redacted by redactURL.
+var secretOptions = map[string]bool{
+	"api-key":                  true,
+	"jwt-secret":               true,
+	"scim-token":               true,
+	"google-oauth-config-data": true,
+	"cookie-secret":            true,
+	"audit-webhook":            true,
+	"anomaly-webhook":          true,
+	"group-resolver-url":       true,
+}
+
+// configEntry is a value in config file. Key is the path in the file, e.g.
+// upstream.timeout, to point the exact key in errors.
+type configEntry struct {
+	key   string
+	value interface{}
+}
+
+// readConfigFile reads a YAML (or JSON) or TOML file of options. Keys are
+// names of flags and nested sections are joined by "-", e.g. timeout in
+// upstream section is upstream-timeout. "_" in keys is same as "-".
+func readConfigFile(path string) (map[string]*configEntry, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read config file: %s", path)
+	}
+
+	var data map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if err := toml.Unmarshal(raw, &data); err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse config file: %s", path)
+		}
+	default:
+		if err := yaml.Unmarshal(raw, &data); err != nil {
+			return nil, errors.Wrapf(err, "Fail to parse config file: %s", path)
+		}
+	}
+
+	entries := map[string]*configEntry{}
+	if err := flattenConfig(nil, data, entries); err != nil {
+		return nil, errors.Wrapf(err, "Invalid config file: %s", path)
+	}
+	return entries, nil
+}
+
+func flattenConfig(path []string, data map[string]interface{}, entries map[string]*configEntry) error {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := append(append([]string{}, path...), key)
+		if section, ok := data[key].(map[string]interface{}); ok {
+			if err := flattenConfig(keyPath, section, entries); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := strings.ReplaceAll(strings.Join(keyPath, "-"), "_", "-")
+		entry := &configEntry{key: strings.Join(keyPath, "."), value: data[key]}
+		if dup, ok := entries[name]; ok {
+			return fmt.Errorf("Key '%s' duplicates '%s'", entry.key, dup.key)
+		}
+		entries[name] = entry
+	}
+
+	return nil
+}
+
+// configValue converts a value of config file to a flag argument. A list is
+// joined by "," for options of comma separated values.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil || strings.Contains(s, ",") {
+				return "", fmt.Errorf("invalid list item: %v", item)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("section is not allowed")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// flagEnvSet returns true if an environment variable of the flag is set.
+func flagEnvSet(f cli.Flag) bool {
+	var envVar string
+	switch v := f.(type) {
+	case cli.StringFlag:
+		envVar = v.EnvVar
+	case cli.IntFlag:
+		envVar = v.EnvVar
+	case cli.Float64Flag:
+		envVar = v.EnvVar
+	case cli.DurationFlag:
+		envVar = v.EnvVar
+	case cli.BoolFlag:
+		envVar = v.EnvVar
+	}
+
+	for _, name := range strings.Split(envVar, ",") {
+		if _, ok := os.LookupEnv(strings.TrimSpace(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue returns the current value of flag from its destination.
+func flagValue(f cli.Flag) interface{} {
+	switch v := f.(type) {
+	case cli.StringFlag:
+		return *v.Destination
+	case cli.IntFlag:
+		return *v.Destination
+	case cli.Float64Flag:
+		return *v.Destination
+	case cli.DurationFlag:
+		return v.Destination.String()
+	case cli.BoolFlag:
+		return *v.Destination
+	}
+	return nil
+}
+
+// commandLineFlag is a hidden flag to keep the flag set of app. Flags visited
+// in the set are given in the command line, while cli.Context.IsSet is also
+// true for flags given by environment variables.
+type commandLineFlag struct {
+	Hidden bool
+	set    *flag.FlagSet
+}
+
+func (x *commandLineFlag) String() string          { return "" }
+func (x *commandLineFlag) GetName() string         { return "" }
+func (x *commandLineFlag) Apply(set *flag.FlagSet) { x.set = set }
+
+// given returns true if the flag is given in the command line.
+func (x *commandLineFlag) given(name string) bool {
+	found := false
+	if x.set != nil {
+		x.set.Visit(func(f *flag.Flag) {
+			found = found || f.Name == name
+		})
+	}
+	return found
+}
+
+// options binds global flags of app to a config file and keeps source of
+// each option value.
+type options struct {
+	flags       []cli.Flag
+	sources     map[string]string
+	commandLine *commandLineFlag
+}
+
+// newOptions binds flags of app. A hidden flag is added to app to know flags
+// given in the command line.
+func newOptions(app *cli.App) *options {
+	x := &options{
+		flags:       app.Flags,
+		sources:     map[string]string{},
+		commandLine: &commandLineFlag{Hidden: true},
+	}
+	app.Flags = append(app.Flags, x.commandLine)
+	return x
+}
+
+// load sets options from config file that are not given by flags or
+// environment variables.
+func (x *options) load(c *cli.Context, path string) error {
+	for _, f := range x.flags {
+		name := flagName(f)
+		switch {
+		case x.commandLine.given(name):
+			x.sources[name] = configSourceFlag
+		case flagEnvSet(f):
+			x.sources[name] = configSourceEnv
+		default:
+			x.sources[name] = configSourceDefault
+		}
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := entries[name]
+		source, ok := x.sources[name]
+		if !ok || name == configFileOption {
+			return fmt.Errorf("Unknown key '%s' in config file %s", entry.key, path)
+		}
+		if source != configSourceDefault {
+			continue
+		}
+
+		value, err := configValue(entry.value)
+		if err == nil {
+			err = c.Set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid value of key '%s' in config file %s: '%v' (%v)", entry.key, path, entry.value, err)
+		}
+		x.sources[name] = configSourceFile
+	}
+
+	logger.WithField("path", path).Debug("Config file loaded")
+	return nil
+}
+
+// print writes effective options as YAML with their sources. Secrets are
+// redacted.
+func (x *options) print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, f := range x.flags {
+		name := flagName(f)
+		if name == configFileOption {
+			continue
+		}
+
+		value := flagValue(f)
+		if secretOptions[name] && value != "" {
+			value = redactedValue
+		} else if s, ok := value.(string); ok {
+			value = redactURL(s)
+		}
+
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+		node := &yaml.Node{}
+		if err := node.Encode(value); err != nil {
+			return errors.Wrapf(err, "Fail to encode option %s", name)
+		}
+		node.LineComment = x.sources[name]
+		doc.Content = append(doc.Content, key, node)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return errors.Wrap(err, "Fail to print config")
+	}
+	return encoder.Close()
+}
+
+// redactURL redacts userinfo and query values of a URL that may have
+// credentials. Value that is not a URL is returned as it is.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	if u.User == nil && u.RawQuery == "" {
+		return value
+	}
+
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redactedValue}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
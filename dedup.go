@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dedupEntry struct {
+	searchID  string
+	expiresAt time.Time
+}
+
+// searchDedup remembers searches created within window to return the
+// existing search ID for an identical query instead of starting a new search
+// in Minerva. A search is forgotten when it's failed.
+type searchDedup struct {
+	window time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+func newSearchDedup(window time.Duration) *searchDedup {
+	return &searchDedup{
+		window:  window,
+		entries: map[string]*dedupEntry{},
+	}
+}
+
+func (x *searchDedup) enabled() bool {
+	return x.window > 0
+}
+
+// searchDedupKey normalizes body of POST /search by re-encoding JSON, i.e.
+// sorting keys and removing spaces, and combines it with backend and
+// permitted tags. It returns an empty string if the body is not a JSON
+// object.
+func searchDedupKey(body json.RawMessage, backend string, permittedTags []string) string {
+	var v map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil || v == nil {
+		return ""
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	tags := append([]string{}, permittedTags...)
+	sort.Strings(tags)
+
+	h := sha256.New()
+	h.Write(normalized)
+	h.Write([]byte("\n" + backend + "\n" + strings.Join(tags, ",")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// find returns search ID of an identical search created within window.
+func (x *searchDedup) find(key string, now time.Time) string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	entry, ok := x.entries[key]
+	if !ok {
+		return ""
+	}
+	if now.After(entry.expiresAt) {
+		delete(x.entries, key)
+		return ""
+	}
+	return entry.searchID
+}
+
+func (x *searchDedup) put(key, searchID string, now time.Time) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for k, entry := range x.entries {
+		if now.After(entry.expiresAt) {
+			delete(x.entries, k)
+		}
+	}
+
+	x.entries[key] = &dedupEntry{
+		searchID:  searchID,
+		expiresAt: now.Add(x.window),
+	}
+}
+
+// searchStatus forgets a failed search so that the query can be retried.
+func (x *searchDedup) searchStatus(searchID, status string) {
+	if status == "" || status == searchStatusRunning || status == searchStatusSucceeded {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for k, entry := range x.entries {
+		if entry.searchID == searchID {
+			delete(x.entries, k)
+		}
+	}
+}
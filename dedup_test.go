@@ -0,0 +1,42 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchDedupKey(t *testing.T) {
+	key := main.SearchDedupKey([]byte(`{"query":[{"term":"10.0.0.1"}],"start_dt":"2026-03-01T00:00:00","end_dt":"2026-03-02T00:00:00"}`), "tokyo", []string{"web", "db"})
+	assert.NotEmpty(t, key)
+
+	// Order of keys, spaces and order of tags are ignored
+	assert.Equal(t, key, main.SearchDedupKey([]byte(`{
+		"end_dt": "2026-03-02T00:00:00",
+		"start_dt": "2026-03-01T00:00:00",
+		"query": [{"term": "10.0.0.1"}]
+	}`), "tokyo", []string{"db", "web"}))
+
+	assert.NotEqual(t, key, main.SearchDedupKey([]byte(`{"query":[{"term":"10.0.0.2"}],"start_dt":"2026-03-01T00:00:00","end_dt":"2026-03-02T00:00:00"}`), "tokyo", []string{"web", "db"}))
+	assert.NotEqual(t, key, main.SearchDedupKey([]byte(`{"query":[{"term":"10.0.0.1"}],"start_dt":"2026-03-01T00:00:00","end_dt":"2026-03-02T00:00:00"}`), "tokyo", []string{"web"}))
+	assert.NotEqual(t, key, main.SearchDedupKey([]byte(`{"query":[{"term":"10.0.0.1"}],"start_dt":"2026-03-01T00:00:00","end_dt":"2026-03-02T00:00:00"}`), "frankfurt", []string{"web", "db"}))
+	assert.Empty(t, main.SearchDedupKey([]byte(`"not object"`), "tokyo", nil))
+}
+
+func TestSearchDedup(t *testing.T) {
+	dedup := main.NewSearchDedup(10 * time.Minute)
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	main.SearchDedupPut(dedup, "k1", "s1", now)
+	assert.Equal(t, "s1", main.SearchDedupFind(dedup, "k1", now.Add(5*time.Minute)))
+	assert.Empty(t, main.SearchDedupFind(dedup, "k1", now.Add(11*time.Minute)))
+
+	// Failed search is not reused
+	main.SearchDedupPut(dedup, "k2", "s2", now)
+	main.SearchDedupStatus(dedup, "s2", "SUCCEEDED")
+	assert.Equal(t, "s2", main.SearchDedupFind(dedup, "k2", now))
+	main.SearchDedupStatus(dedup, "s2", "FAILED")
+	assert.Empty(t, main.SearchDedupFind(dedup, "k2", now))
+}
@@ -1,13 +1,369 @@
 package main
 
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/urfave/cli"
+)
+
 type AuthzUser authzUser
 
 var NewAuthzService = newAuthzService
 
 func AuthzServiceLookup(x *authzService, userID string) *AuthzUser {
-	return (*AuthzUser)(x.lookup(userID))
+	return (*AuthzUser)(x.lookup(userID, nil))
+}
+func AuthzServiceLookupWithGroups(x *authzService, userID string, groups []string) *AuthzUser {
+	return (*AuthzUser)(x.lookup(userID, groups))
 }
 func AuthzUserAllowed(x *AuthzUser) []string {
 	authz := (*authzUser)(x)
 	return authz.rolePtr.PermittedTags
 }
+
+var NewAuthzServiceFromPath = newAuthzServiceFromPath
+
+type Arguments = arguments
+
+var SetupAuthz = setupAuthz
+
+func AuthzHolderLookup(x *authzHolder, userID string) *AuthzUser {
+	srv := x.get()
+	if srv == nil {
+		return nil
+	}
+	return AuthzServiceLookup(srv, userID)
+}
+
+var NewScimStore = newScimStore
+var SetupSCIM = setupSCIM
+
+var NewAuthzHolder = newAuthzHolder
+
+func NewAuthzHolderWithDirectory(srv *authzService, store *scimStore) *authzHolder {
+	holder := newAuthzHolder(srv, false)
+	holder.directory = store
+	return holder
+}
+
+func AuthzHolderResolve(x *authzHolder, userID string, groups []string) *AuthzUser {
+	user, err := x.lookup(userID, groups)
+	if err != nil {
+		return nil
+	}
+	return (*AuthzUser)(user)
+}
+
+type AuditEvent = auditEvent
+
+var SetupAudit = setupAudit
+var VerifyAuditFiles = verifyAuditFiles
+
+func AuditLog(x *auditLogger, ev *auditEvent) { x.log(ev) }
+func AuditClose(x *auditLogger) error         { return x.close() }
+
+type AnomalyConfig = anomalyConfig
+type AuditSearch = auditSearch
+type AuditResult = auditResult
+
+var NewAuditSearch = newAuditSearch
+var CountAuditLogs = countAuditLogs
+
+type anomalyRecorder struct{ kinds []string }
+
+func (x *anomalyRecorder) send(alert *anomalyAlert) error {
+	x.kinds = append(x.kinds, alert.Kind)
+	return nil
+}
+
+// DetectAnomalies learns baseline from past events and returns kinds of
+// alerts raised by events.
+func DetectAnomalies(config anomalyConfig, past, events []*auditEvent) []string {
+	recorder := &anomalyRecorder{}
+	detector := newAnomalyDetector(config, recorder)
+	for _, ev := range past {
+		detector.process(ev)
+	}
+	detector.alerting = true
+	for _, ev := range events {
+		detector.process(ev)
+	}
+	return recorder.kinds
+}
+
+type RateLimit = rateLimit
+
+var NewMemoryRateLimitStore = newMemoryRateLimitStore
+
+func RateLimitTake(x *memoryRateLimitStore, key string, limit rateLimit, now time.Time) time.Duration {
+	wait, _ := x.take(key, limit, now)
+	return wait
+}
+
+func RateLimitAcquire(x *memoryRateLimitStore, key, id string, max int, now time.Time) bool {
+	ok, _ := x.acquire(key, id, max, now)
+	return ok
+}
+
+func RateLimitRelease(x *memoryRateLimitStore, key, id string) { x.release(key, id) }
+
+// RateLimitOf returns rate limit of the user with defaults.
+func RateLimitOf(srv *authzService, userID string, defaults rateLimit) rateLimit {
+	user := srv.lookup(userID, nil)
+	return newRateLimiter(newMemoryRateLimitStore(), defaults).limitOf(user)
+}
+
+var NewResponseCache = newResponseCache
+
+// ResponseCacheDo requests through the cache and returns cache status.
+// fetch is called with the upstream body to count upstream calls.
+func ResponseCacheDo(x *responseCache, key, searchID string, isStatus bool, fetch func() string) string {
+	_, status := x.do(key, searchID, isStatus, func() *cachedResponse {
+		return &cachedResponse{status: 200, header: http.Header{}, body: []byte(fetch())}
+	})
+	return status
+}
+
+var SearchDedupKey = searchDedupKey
+var NewSearchDedup = newSearchDedup
+
+func SearchDedupFind(x *searchDedup, key string, now time.Time) string { return x.find(key, now) }
+func SearchDedupPut(x *searchDedup, key, searchID string, now time.Time) {
+	x.put(key, searchID, now)
+}
+func SearchDedupStatus(x *searchDedup, searchID, status string) { x.searchStatus(searchID, status) }
+
+type BackendConfig = backendConfig
+type MinervaBackend = minervaBackend
+type BackendRoute = backendRoute
+
+var NewBackendRouter = newBackendRouter
+
+// BackendRouteOf returns name of backend selected for a new search by userID.
+func BackendRouteOf(x *backendRouter, srv *authzService, userID, selector string, tags []string) (string, error) {
+	b, err := x.route(srv.lookup(userID, nil), selector, tags)
+	if err != nil {
+		return "", err
+	}
+	return b.Name, nil
+}
+
+// BackendResolve returns backend name and search ID of the backend.
+func BackendResolve(x *backendRouter, srv *authzService, userID, searchID string) (string, string, error) {
+	b, rawID, err := x.resolve(srv.lookup(userID, nil), searchID)
+	if err != nil {
+		return "", "", err
+	}
+	return b.Name, rawID, nil
+}
+
+func BackendSearchID(x *backendRouter, name, rawID string) string {
+	return x.searchID(x.byName[name], rawID)
+}
+
+// MergeFederated merges responses of backends for a federated request of
+// suffix ("", "/logs" or "/timeseries"). Backends with an empty body are
+// treated as failed.
+func MergeFederated(suffix string, bodies map[string]string, offset, limit int) (int, http.Header, string) {
+	var results []*backendResult
+	for name, body := range bodies {
+		r := &backendResult{Name: name, body: []byte(body)}
+		if body == "" {
+			r.Error = "failed"
+		}
+		results = append(results, r)
+	}
+
+	var resp *cachedResponse
+	switch suffix {
+	case "/logs":
+		resp = mergeLogs(results, offset, limit)
+	case "/timeseries":
+		resp = mergeTimeseries(results)
+	default:
+		resp = mergeStatus(results)
+	}
+	return resp.status, resp.header, string(resp.body)
+}
+
+type UpstreamConfig = upstreamConfig
+type BackendRouter = backendRouter
+type UpstreamTLS = upstreamTLS
+
+// BackendDo sends a request to the backend and returns status code. Status
+// of a failed request is one returned to clients.
+func BackendDo(x *backendRouter, name, method, path, body string) int {
+	b := x.byName[name]
+	req, _ := http.NewRequest(method, b.url.String(), strings.NewReader(body))
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		path, req.URL.RawQuery = path[:idx], path[idx+1:]
+	}
+	b.direct(req, path)
+
+	resp, err := b.roundTrip(req)
+	if err != nil {
+		status, _ := upstreamError(err)
+		return status
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// BackendRead sends GET request to the backend directly and returns the
+// response body.
+func BackendRead(x *backendRouter, name, path string) (string, error) {
+	b := x.byName[name]
+	req, _ := http.NewRequest(http.MethodGet, b.url.String(), nil)
+	b.direct(req, path)
+
+	resp, err := b.roundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	return string(raw), err
+}
+
+// APIKeyReload reloads API key file of the backend.
+func APIKeyReload(x *backendRouter, name string) (bool, error) {
+	return x.byName[name].apiKeys.reload()
+}
+
+var APIKeyFingerprint = apiKeyFingerprint
+
+var NewServerTLSConfig = newServerTLSConfig
+var RedirectHTTPS = redirectHTTPS
+
+// ClientCertUser returns user ID and groups identified by client certificate.
+func ClientCertUser(req *http.Request) (string, []string) {
+	user := clientCertUser(req)
+	if user == nil {
+		return "", nil
+	}
+	return user.UserID, user.Groups
+}
+
+type ServerState = serverState
+
+var Serve = serve
+
+func ServerReady(x *serverState) bool { return x.ready() }
+
+// NewHealthHandler returns handler of health endpoints.
+func NewHealthHandler(state *serverState, holder *authzHolder, router *backendRouter, ttl time.Duration) http.Handler {
+	r := gin.New()
+	setupHealth(&readiness{
+		state: state,
+		authz: holder,
+		probe: newBackendProbe(router, ttl),
+	}, r)
+	return r
+}
+
+func DrainServer(x *serverState) { x.drain() }
+
+// NewMetricsServer returns a handler of API with metrics. User of a request
+// is given by X-User header instead of session.
+func NewMetricsServer(holder *authzHolder, router *backendRouter) (http.Handler, *auditLogger) {
+	r := gin.New()
+	audit := newAuditLogger(&loggerAuditSink{})
+	limiter := newRateLimiter(newMemoryRateLimitStore(), rateLimit{})
+	if err := setupMetrics(audit, limiter, r); err != nil {
+		panic(err)
+	}
+
+	api := r.Group("/api/v1")
+	api.Use(metricsMiddleware, func(c *gin.Context) {
+		c.Set("request_id", "req-"+c.GetHeader("X-User"))
+		c.Set("session", &strixUser{UserID: c.GetHeader("X-User"), ExpiresAt: time.Now().Add(time.Hour)})
+	})
+	setupAPI(holder, audit, limiter, newResponseCache(time.Minute, 1<<20), newSearchDedup(0), router, api)
+	return r, audit
+}
+
+func NewAuthnDenyEvent(reason string) *auditEvent {
+	return &auditEvent{Type: auditAuthn, Outcome: auditDeny, Reason: reason}
+}
+
+var SetupTracing = setupTracing
+
+// newTestAPI returns a handler of API with middlewares. User of a request is
+// given by X-User header instead of session.
+func newTestAPI(holder *authzHolder, audit *auditLogger, router *backendRouter, cache *responseCache, middlewares ...gin.HandlerFunc) http.Handler {
+	r := gin.New()
+	limiter := newRateLimiter(newMemoryRateLimitStore(), rateLimit{})
+
+	api := r.Group("/api/v1")
+	api.Use(middlewares...)
+	api.Use(func(c *gin.Context) {
+		c.Set("request_id", "req-"+c.GetHeader("X-User"))
+		c.Set("session", &strixUser{UserID: c.GetHeader("X-User"), ExpiresAt: time.Now().Add(time.Hour)})
+	})
+	setupAPI(holder, audit, limiter, cache, newSearchDedup(0), router, api)
+	return r
+}
+
+// NewProxyServer returns a handler of API with the response cache.
+func NewProxyServer(holder *authzHolder, router *backendRouter, cache *responseCache) http.Handler {
+	return newTestAPI(holder, newAuditLogger(&loggerAuditSink{}), router, cache)
+}
+
+// NewTracingServer returns a handler of API with tracing.
+func NewTracingServer(holder *authzHolder, router *backendRouter) http.Handler {
+	return newTestAPI(holder, newAuditLogger(&loggerAuditSink{}), router, newResponseCache(time.Minute, 1<<20), tracingMiddleware)
+}
+
+// NewAuditedProxyServer returns a handler of API with the audit logger.
+func NewAuditedProxyServer(holder *authzHolder, router *backendRouter, audit *auditLogger) http.Handler {
+	return newTestAPI(holder, audit, router, newResponseCache(0, 0))
+}
+
+// NewAuditViewerServer returns a handler of API with the audit logger.
+func NewAuditViewerServer(holder *authzHolder, audit *auditLogger) http.Handler {
+	return newTestAPI(holder, audit, nil, newResponseCache(0, 0))
+}
+
+type Options = options
+
+var NewOptions = newOptions
+
+func (x *options) Load(c *cli.Context, path string) error { return x.load(c, path) }
+func (x *options) Print(w io.Writer) error                { return x.print(w) }
+
+// NewWebHandler returns a handler serving web UI of files.
+func NewWebHandler(files fs.FS, basePath string, immutable bool) (http.Handler, error) {
+	ui, err := newWebUIFS(files, basePath, immutable)
+	if err != nil {
+		return nil, err
+	}
+	r := gin.New()
+	r.NoRoute(ui.serve)
+	return r, nil
+}
+
+// NewEmbeddedWebUI checks that the embedded web UI is loaded.
+func NewEmbeddedWebUI(basePath string) error {
+	_, err := newWebUI("", basePath)
+	return err
+}
+
+var (
+	NormalizeBasePath = normalizeBasePath
+	WithBasePath      = withBasePath
+)
+
+type StrixUser = strixUser
+
+var ClaimToStrixUser = claimToStrixUser
+var NewHTTPGroupResolver = newHTTPGroupResolver
+
+func GroupResolve(x *httpGroupResolver, ctx context.Context, userID string) ([]string, error) {
+	return x.resolve(ctx, userID)
+}
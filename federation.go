@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// federatedBackendName is prefix of composite search ID and can not be
+	// used as a backend name.
+	federatedBackendName = "federated"
+
+	federatedDefaultLimit = 50
+	federatedMaxError     = 256
+
+	// federatedMaxWindow is max offset+limit of logs of a federated search
+	// because each backend returns all logs before the page to merge them.
+	federatedMaxWindow = 10000
+)
+
+// errFederatedCreate is reported for a backend that failed to create the
+// search. The actual error is logged and not kept in the search ID.
+const errFederatedCreate = "Fail to create search"
+
+// federatedSearchIDPattern is a search ID of a backend in composite search ID.
+// It's put into path of upstream request and must not change the path.
+var federatedSearchIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// federatedID is a composite search ID having search IDs of backends and
+// names of backends failed to create the search. It's encoded into the ID
+// itself so that any replica of strix can serve the search.
+type federatedID struct {
+	Searches map[string]string `json:"s"`
+	Failed   []string          `json:"f,omitempty"`
+}
+
+func (x *federatedID) String() string {
+	raw, _ := json.Marshal(x)
+	return federatedBackendName + backendSeparator + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func isFederatedID(searchID string) bool {
+	return strings.HasPrefix(searchID, federatedBackendName+backendSeparator)
+}
+
+func parseFederatedID(searchID string) (*federatedID, error) {
+	encoded := strings.TrimPrefix(searchID, federatedBackendName+backendSeparator)
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid federated search ID")
+	}
+
+	var id federatedID
+	if err := json.Unmarshal(raw, &id); err != nil || len(id.Searches) == 0 {
+		return nil, fmt.Errorf("Invalid federated search ID")
+	}
+	for name, searchID := range id.Searches {
+		if !federatedSearchIDPattern.MatchString(searchID) {
+			return nil, fmt.Errorf("Invalid search ID of %s in federated search ID", name)
+		}
+	}
+	return &id, nil
+}
+
+// isFederatedSelector returns true if backend selector is "*" (all permitted
+// backends) or a comma separated list of backends.
+func isFederatedSelector(selector string) bool {
+	return selector == "*" || strings.Contains(selector, ",")
+}
+
+// federated returns backends of a federated search.
+func (x *backendRouter) federated(user *authzUser, selector string) ([]*minervaBackend, error) {
+	if selector == "*" {
+		backends := x.available(user)
+		if len(backends) == 0 {
+			return nil, errBackendForbidden
+		}
+		return backends, nil
+	}
+
+	var backends []*minervaBackend
+	for _, name := range uniqueStrings(strings.Split(selector, ",")) {
+		b, ok := x.byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errBackendNotFound, name)
+		}
+		if !x.permitted(user, b) {
+			return nil, fmt.Errorf("%w: %s", errBackendForbidden, name)
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// resolveFederated parses composite search ID and checks that the user can
+// search all backends of it.
+func (x *backendRouter) resolveFederated(user *authzUser, searchID string) (*federatedID, error) {
+	id, err := parseFederatedID(searchID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBackendNotFound, err.Error())
+	}
+
+	for name := range id.Searches {
+		b, ok := x.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errBackendNotFound, name)
+		}
+		if !x.permitted(user, b) {
+			return nil, fmt.Errorf("%w: %s", errBackendForbidden, name)
+		}
+	}
+	return id, nil
+}
+
+// backendResult is a response of a backend in a federated search. It's
+// reported to client to tell which backend failed.
+type backendResult struct {
+	Name     string `json:"name"`
+	SearchID string `json:"search_id,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	backend  *minervaBackend
+	body     []byte
+}
+
+func (x *backendResult) failed() bool {
+	return x.Error != ""
+}
+
+// federation sends a request to multiple backends in parallel and merges
+// responses.
+type federation struct {
+	ctx    context.Context
+	header http.Header
+}
+
+func (x *federation) call(b *minervaBackend, method, path string, query url.Values, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(x.ctx, method, b.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create request")
+	}
+	for k, v := range x.header {
+		req.Header[k] = v
+	}
+	req.URL.RawQuery = query.Encode()
+	b.direct(req, path)
+
+	resp, err := b.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read response")
+	}
+	if resp.StatusCode >= 300 {
+		if len(raw) > federatedMaxError {
+			raw = raw[:federatedMaxError]
+		}
+		return nil, fmt.Errorf("Status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+
+	return raw, nil
+}
+
+func (x *federation) fanOut(results []*backendResult, call func(r *backendResult) ([]byte, error)) {
+	var wg sync.WaitGroup
+	for _, r := range results {
+		if r.failed() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *backendResult) {
+			defer wg.Done()
+			body, err := call(r)
+			if err != nil {
+				logger.WithError(err).WithField("backend", r.Name).Warn("Backend failed in federated search")
+				r.Error = err.Error()
+				return
+			}
+			r.body = body
+		}(r)
+	}
+	wg.Wait()
+}
+
+func succeeded(results []*backendResult) []*backendResult {
+	var ok []*backendResult
+	for _, r := range results {
+		if !r.failed() {
+			ok = append(ok, r)
+		}
+	}
+	return ok
+}
+
+// partialHeader tells backends failed in a federated search. A response
+// having it is not cached.
+const partialHeader = "X-Strix-Partial"
+
+func federatedResponse(results []*backendResult, data map[string]interface{}) *cachedResponse {
+	data["backends"] = results
+	resp := jsonResponse(http.StatusOK, data)
+
+	var failed []string
+	for _, r := range results {
+		if r.failed() {
+			failed = append(failed, r.Name)
+		}
+	}
+	if len(failed) > 0 {
+		resp.header.Set(partialHeader, strings.Join(failed, ","))
+	}
+	return resp
+}
+
+func jsonResponse(status int, data interface{}) *cachedResponse {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		status = http.StatusInternalServerError
+		raw = []byte(`{"msg":"Fail to marshal response"}`)
+	}
+
+	return &cachedResponse{
+		status: status,
+		header: http.Header{"Content-Type": []string{"application/json; charset=utf-8"}},
+		body:   raw,
+	}
+}
+
+func allFailed(results []*backendResult) *cachedResponse {
+	return jsonResponse(http.StatusBadGateway, map[string]interface{}{
+		"msg":      "All backends failed",
+		"backends": results,
+	})
+}
+
+// create starts a search in each backend and returns composite search ID.
+func (x *federation) create(backends []*minervaBackend, path string, query url.Values, body []byte) *cachedResponse {
+	var results []*backendResult
+	for _, b := range backends {
+		results = append(results, &backendResult{Name: b.Name, backend: b})
+	}
+
+	x.fanOut(results, func(r *backendResult) ([]byte, error) {
+		raw, err := x.call(r.backend, http.MethodPost, path, query, body)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp struct {
+			SearchID string `json:"search_id"`
+		}
+		if err := json.Unmarshal(raw, &resp); err != nil || resp.SearchID == "" {
+			return nil, fmt.Errorf("No search_id in response")
+		}
+		r.SearchID = resp.SearchID
+		return raw, nil
+	})
+
+	id := &federatedID{Searches: map[string]string{}}
+	for _, r := range results {
+		if r.failed() {
+			id.Failed = append(id.Failed, r.Name)
+		} else {
+			id.Searches[r.Name] = r.SearchID
+		}
+	}
+
+	if len(id.Searches) == 0 {
+		return allFailed(results)
+	}
+
+	return federatedResponse(results, map[string]interface{}{
+		"search_id": id.String(),
+	})
+}
+
+// get fetches status, logs or timeseries (by suffix of path) of the search
+// from backends and merges them. path is the request path having composite
+// search ID.
+func (x *federation) get(router *backendRouter, id *federatedID, searchID, path, suffix string, query url.Values) *cachedResponse {
+	var results []*backendResult
+	for name, rawID := range id.Searches {
+		results = append(results, &backendResult{Name: name, SearchID: rawID, backend: router.byName[name]})
+	}
+	for _, name := range id.Failed {
+		results = append(results, &backendResult{Name: name, Error: errFederatedCreate})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	backendQuery := query
+	offset, limit := 0, federatedDefaultLimit
+	if suffix == "/logs" {
+		// Each backend returns logs from the top to offset+limit to sort all
+		// logs by timestamp and take the page.
+		if v, err := strconv.Atoi(query.Get("offset")); err == nil && v > 0 {
+			offset = v
+		}
+		if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 {
+			limit = v
+		}
+		if offset+limit > federatedMaxWindow {
+			return jsonResponse(http.StatusBadRequest, map[string]interface{}{
+				"msg": fmt.Sprintf("offset + limit of federated search must be %d or less", federatedMaxWindow),
+			})
+		}
+		backendQuery = url.Values{}
+		for k, v := range query {
+			backendQuery[k] = v
+		}
+		backendQuery.Set("offset", "0")
+		backendQuery.Set("limit", strconv.Itoa(offset+limit))
+	}
+
+	x.fanOut(results, func(r *backendResult) ([]byte, error) {
+		backendPath := strings.Replace(path, "/search/"+searchID, "/search/"+r.SearchID, 1)
+		return x.call(r.backend, http.MethodGet, backendPath, backendQuery, nil)
+	})
+
+	if len(succeeded(results)) == 0 {
+		return allFailed(results)
+	}
+
+	switch suffix {
+	case "/logs":
+		return mergeLogs(results, offset, limit)
+	case "/timeseries":
+		return mergeTimeseries(results)
+	default:
+		return mergeStatus(results)
+	}
+}
+
+// mergeMetadata sums numbers (max for elapsed_seconds) and joins lists of
+// metadata. Other fields are taken from the first one.
+func mergeMetadata(metas []map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, m := range metas {
+		for k, v := range m {
+			current, ok := merged[k]
+			if !ok {
+				merged[k] = v
+				continue
+			}
+
+			switch value := v.(type) {
+			case float64:
+				if c, ok := current.(float64); ok {
+					if k == "elapsed_seconds" {
+						if value > c {
+							merged[k] = value
+						}
+					} else {
+						merged[k] = c + value
+					}
+				}
+			case []interface{}:
+				if c, ok := current.([]interface{}); ok {
+					merged[k] = unionValues(c, value)
+				}
+			}
+		}
+	}
+	return merged
+}
+
+func unionValues(a, b []interface{}) []interface{} {
+	union := append([]interface{}{}, a...)
+	seen := map[string]bool{}
+	for _, v := range a {
+		seen[fmt.Sprint(v)] = true
+	}
+	for _, v := range b {
+		if !seen[fmt.Sprint(v)] {
+			union = append(union, v)
+			seen[fmt.Sprint(v)] = true
+		}
+	}
+	return union
+}
+
+// mergeStatus returns RUNNING if any backend is running, otherwise SUCCEEDED
+// if any backend succeeded. A backend with other status is reported as
+// failed.
+func mergeStatus(results []*backendResult) *cachedResponse {
+	var metas []map[string]interface{}
+	running, done := false, false
+
+	for _, r := range succeeded(results) {
+		var resp struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		}
+		if err := json.Unmarshal(r.body, &resp); err != nil {
+			r.Error = "Invalid response: " + err.Error()
+			continue
+		}
+
+		r.Status, _ = resp.Metadata["status"].(string)
+		switch r.Status {
+		case searchStatusRunning:
+			running = true
+		case searchStatusSucceeded:
+			done = true
+		default:
+			r.Error = "Search status: " + r.Status
+			continue
+		}
+		metas = append(metas, resp.Metadata)
+	}
+
+	if len(metas) == 0 {
+		return allFailed(results)
+	}
+
+	metadata := mergeMetadata(metas)
+	metadata["status"] = searchStatusSucceeded
+	if running || !done {
+		metadata["status"] = searchStatusRunning
+	}
+
+	return federatedResponse(results, map[string]interface{}{
+		"metadata": metadata,
+	})
+}
+
+type federatedLog struct {
+	fields    map[string]json.RawMessage
+	timestamp float64
+}
+
+// mergeLogs sorts logs of all backends by timestamp and returns a page of
+// offset and limit. Each log has name of the backend as "backend" field.
+func mergeLogs(results []*backendResult, offset, limit int) *cachedResponse {
+	var logs []*federatedLog
+	var metas []map[string]interface{}
+
+	for _, r := range succeeded(results) {
+		var resp struct {
+			Logs     []map[string]json.RawMessage `json:"logs"`
+			Metadata map[string]interface{}       `json:"metadata"`
+		}
+		if err := json.Unmarshal(r.body, &resp); err != nil {
+			r.Error = "Invalid response: " + err.Error()
+			continue
+		}
+
+		backend, _ := json.Marshal(r.Name)
+		for _, fields := range resp.Logs {
+			log := &federatedLog{fields: fields}
+			json.Unmarshal(fields["timestamp"], &log.timestamp)
+			fields["backend"] = backend
+			logs = append(logs, log)
+		}
+		metas = append(metas, resp.Metadata)
+	}
+
+	if len(metas) == 0 {
+		return allFailed(results)
+	}
+
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].timestamp < logs[j].timestamp })
+
+	page := []map[string]json.RawMessage{}
+	for i := offset; i < len(logs) && i < offset+limit; i++ {
+		page = append(page, logs[i].fields)
+	}
+
+	metadata := mergeMetadata(metas)
+	metadata["offset"] = offset
+	metadata["limit"] = limit
+
+	return federatedResponse(results, map[string]interface{}{
+		"logs":     page,
+		"metadata": metadata,
+	})
+}
+
+// mergeTimeseries sums counts of each tag by label (time bucket). Labels are
+// sorted as numbers if all of them are numbers, otherwise as strings.
+func mergeTimeseries(results []*backendResult) *cachedResponse {
+	labels := map[string]interface{}{}
+	counts := map[string]map[string]float64{}
+	merged := 0
+
+	for _, r := range succeeded(results) {
+		var resp struct {
+			Labels     []interface{}        `json:"labels"`
+			Timeseries map[string][]float64 `json:"timeseries"`
+		}
+		if err := json.Unmarshal(r.body, &resp); err != nil {
+			r.Error = "Invalid response: " + err.Error()
+			continue
+		}
+		merged++
+
+		for i, label := range resp.Labels {
+			key := fmt.Sprint(label)
+			labels[key] = label
+			for tag, series := range resp.Timeseries {
+				if i >= len(series) {
+					continue
+				}
+				if counts[tag] == nil {
+					counts[tag] = map[string]float64{}
+				}
+				counts[tag][key] += series[i]
+			}
+		}
+	}
+
+	if merged == 0 {
+		return allFailed(results)
+	}
+
+	keys := make([]string, 0, len(labels))
+	numeric := true
+	for key, label := range labels {
+		keys = append(keys, key)
+		if _, ok := label.(float64); !ok {
+			numeric = false
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if numeric {
+			return labels[keys[i]].(float64) < labels[keys[j]].(float64)
+		}
+		return keys[i] < keys[j]
+	})
+
+	sortedLabels := make([]interface{}, len(keys))
+	timeseries := map[string][]float64{}
+	for i, key := range keys {
+		sortedLabels[i] = labels[key]
+	}
+	for tag, byLabel := range counts {
+		series := make([]float64, len(keys))
+		for i, key := range keys {
+			series[i] = byLabel[key]
+		}
+		timeseries[tag] = series
+	}
+
+	return federatedResponse(results, map[string]interface{}{
+		"labels":     sortedLabels,
+		"timeseries": timeseries,
+	})
+}
+
+// readBody reads request body and restores it.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read request body")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	return raw, nil
+}
@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFederatedStatus(t *testing.T) {
+	status, header, body := main.MergeFederated("", map[string]string{
+		"tokyo": `{"metadata":{"status":"SUCCEEDED","elapsed_seconds":3,"total":10}}`,
+		"eu":    `{"metadata":{"status":"RUNNING","elapsed_seconds":5,"total":2}}`,
+		"us":    "",
+	}, 0, 0)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "us", header.Get("X-Strix-Partial"))
+
+	var resp struct {
+		Metadata map[string]interface{} `json:"metadata"`
+		Backends []map[string]string    `json:"backends"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, "RUNNING", resp.Metadata["status"])
+	assert.Equal(t, 5.0, resp.Metadata["elapsed_seconds"])
+	assert.Equal(t, 12.0, resp.Metadata["total"])
+	assert.Equal(t, 3, len(resp.Backends))
+
+	status, _, _ = main.MergeFederated("", map[string]string{"tokyo": "", "eu": ""}, 0, 0)
+	assert.Equal(t, 502, status)
+}
+
+func TestFederatedLogs(t *testing.T) {
+	status, _, body := main.MergeFederated("/logs", map[string]string{
+		"tokyo": `{"logs":[{"tag":"web","timestamp":1,"log":{}},{"tag":"web","timestamp":4,"log":{}}],"metadata":{"total":2,"sub_total":2,"tags":["web"]}}`,
+		"eu":    `{"logs":[{"tag":"db","timestamp":2,"log":{}},{"tag":"db","timestamp":3,"log":{}}],"metadata":{"total":2,"sub_total":2,"tags":["db"]}}`,
+	}, 1, 2)
+	assert.Equal(t, 200, status)
+
+	var resp struct {
+		Logs []struct {
+			Backend   string  `json:"backend"`
+			Timestamp float64 `json:"timestamp"`
+		} `json:"logs"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	require.Equal(t, 2, len(resp.Logs))
+	assert.Equal(t, "eu", resp.Logs[0].Backend)
+	assert.Equal(t, 2.0, resp.Logs[0].Timestamp)
+	assert.Equal(t, 3.0, resp.Logs[1].Timestamp)
+	assert.Equal(t, 4.0, resp.Metadata["sub_total"])
+	assert.Equal(t, 1.0, resp.Metadata["offset"])
+	assert.Equal(t, 2.0, resp.Metadata["limit"])
+	assert.ElementsMatch(t, []interface{}{"web", "db"}, resp.Metadata["tags"])
+}
+
+func TestFederatedTimeseries(t *testing.T) {
+	_, _, body := main.MergeFederated("/timeseries", map[string]string{
+		"tokyo": `{"labels":[100,200],"timeseries":{"web":[1,2]}}`,
+		"eu":    `{"labels":[200,300],"timeseries":{"web":[3,4],"db":[5,6]}}`,
+	}, 0, 0)
+
+	var resp struct {
+		Labels     []float64            `json:"labels"`
+		Timeseries map[string][]float64 `json:"timeseries"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, []float64{100, 200, 300}, resp.Labels)
+	assert.Equal(t, []float64{1, 5, 4}, resp.Timeseries["web"])
+	assert.Equal(t, []float64{0, 5, 6}, resp.Timeseries["db"])
+}
+
+func TestFederatedSearchID(t *testing.T) {
+	tokyo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			w.Write([]byte(`{"search_id":"tokyo-search"}`))
+			return
+		}
+		w.Write([]byte(`{"metadata":{"status":"SUCCEEDED","total":1}}`))
+	}))
+	defer tokyo.Close()
+	osaka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`connection refused by db-internal.osaka:5432`))
+	}))
+	defer osaka.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: tokyo.URL, APIKey: "tokyo-key"},
+			{Name: "osaka", Endpoint: osaka.URL, APIKey: "osaka-key"},
+		},
+	})
+	require.NoError(t, err)
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name": "analyst", "permitted_tags": ["web"]}],
+		"users": [{"user_id": "blue@example.com", "role": "analyst"}]
+	}`))
+	require.NoError(t, err)
+
+	s := httptest.NewServer(main.NewProxyServer(main.NewAuthzHolder(srv, false), router, main.NewResponseCache(0, 0)))
+	defer s.Close()
+
+	send := func(method, path, body string) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", "blue@example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, raw
+	}
+
+	code, raw := send(http.MethodPost, "/api/v1/search?backend=*", `{"query":[{"term":"x"}]}`)
+	require.Equal(t, http.StatusOK, code)
+	var created struct {
+		SearchID string `json:"search_id"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &created))
+
+	// Only name of the failed backend is in the search ID
+	encoded := created.SearchID[strings.LastIndex(created.SearchID, ".")+1:]
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	assert.Contains(t, string(decoded), `"osaka"`)
+	assert.NotContains(t, string(decoded), "db-internal")
+
+	code, raw = send(http.MethodGet, "/api/v1/search/"+created.SearchID, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, string(raw), "db-internal")
+	assert.Contains(t, string(raw), `"error":"Fail to create search"`)
+
+	// Deep pagination is rejected
+	code, _ = send(http.MethodGet, "/api/v1/search/"+created.SearchID+"/logs?offset=9990&limit=20", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(http.MethodGet, "/api/v1/search/"+created.SearchID+"/logs?offset=9950&limit=50", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Search ID of a backend must not change path of upstream request
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"s":{"tokyo":"x/../../admin"}}`))
+	code, _ = send(http.MethodGet, "/api/v1/search/federated."+forged, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
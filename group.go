@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// groupResolver retrieves group memberships of a user from a directory
+// service at login.
+type groupResolver interface {
+	resolve(ctx context.Context, userID string) ([]string, error)
+}
+
+// httpGroupResolver queries an HTTP endpoint as "<endpoint>?user=<userID>"
+// and expects a JSON response such as {"groups": ["security", "sre"]}.
+type httpGroupResolver struct {
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newHTTPGroupResolver(endpoint string) (*httpGroupResolver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse group resolver URL: %s", endpoint)
+	}
+
+	return &httpGroupResolver{
+		endpoint: u,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (x *httpGroupResolver) resolve(ctx context.Context, userID string) ([]string, error) {
+	u := *x.endpoint
+	qs := u.Query()
+	qs.Set("user", userID)
+	u.RawQuery = qs.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create group resolver request")
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to request group resolver: %s", x.endpoint)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Group resolver returned status %d for %s", resp.StatusCode, userID)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read group resolver response")
+	}
+
+	var result struct {
+		Groups []string `json:"groups"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse group resolver response: %s", string(raw))
+	}
+
+	return result.Groups, nil
+}
@@ -0,0 +1,64 @@
+package main_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPGroupResolver(t *testing.T) {
+	resolve := func(t *testing.T, handler http.HandlerFunc, ctx context.Context) ([]string, error) {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+
+		resolver, err := main.NewHTTPGroupResolver(srv.URL + "/groups?tenant=strix")
+		require.NoError(t, err)
+		return main.GroupResolve(resolver, ctx, "blue@example.com")
+	}
+
+	t.Run("groups of the user", func(t *testing.T) {
+		groups, err := resolve(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/groups", r.URL.Path)
+			assert.Equal(t, "strix", r.URL.Query().Get("tenant"))
+			assert.Equal(t, "blue@example.com", r.URL.Query().Get("user"))
+			w.Write([]byte(`{"groups":["security","sre"]}`))
+		}, context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"security", "sre"}, groups)
+	})
+
+	t.Run("status is not 200", func(t *testing.T) {
+		_, err := resolve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}, context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "status 404")
+	})
+
+	t.Run("bad JSON", func(t *testing.T) {
+		_, err := resolve(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"groups":"security"`))
+		}, context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Fail to parse group resolver response")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := resolve(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}, ctx)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information embedded by ldflags, e.g.
+// -X main.gitCommit=$(git rev-parse HEAD). VCS information of Go build is
+// used if they are not set.
+var (
+	gitCommit string
+	buildTime string
+)
+
+type versionInfo struct {
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func getVersionInfo() versionInfo {
+	info := versionInfo{
+		GitCommit: gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range build.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+
+	return info
+}
+
+const (
+	probeTimeout  = 3 * time.Second
+	checkOK       = "ok"
+	checkNotReady = "not_ready"
+	checkFail     = "fail"
+)
+
+type probeResult struct {
+	err       error
+	checkedAt time.Time
+}
+
+// backendProbe checks that backends are reachable. Any HTTP response
+// except 502, 503 and 504 means reachable even if it's an error, e.g. 403
+// for the root path. Results are cached for ttl not to call Minerva by
+// every readiness probe.
+type backendProbe struct {
+	router *backendRouter
+	ttl    time.Duration
+
+	mutex   sync.Mutex
+	results map[string]*probeResult
+}
+
+func newBackendProbe(router *backendRouter, ttl time.Duration) *backendProbe {
+	return &backendProbe{
+		router:  router,
+		ttl:     ttl,
+		results: map[string]*probeResult{},
+	}
+}
+
+func (x *backendProbe) probe(ctx context.Context, b *minervaBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.transport.RoundTrip(req)
+	if isUpstreamFailure(resp, err) {
+		if err == nil {
+			resp.Body.Close()
+			return fmt.Errorf("Status %d", resp.StatusCode)
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// check returns result of each backend. Backends are probed in parallel if
+// cached results are expired.
+func (x *backendProbe) check(ctx context.Context) map[string]error {
+	// A probe is not canceled by the client to cache the result
+	ctx = context.WithoutCancel(ctx)
+	now := time.Now()
+	results := map[string]error{}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, b := range x.router.backends {
+		x.mutex.Lock()
+		cached, ok := x.results[b.Name]
+		x.mutex.Unlock()
+
+		if ok && now.Sub(cached.checkedAt) < x.ttl {
+			results[b.Name] = cached.err
+			continue
+		}
+
+		wg.Add(1)
+		go func(b *minervaBackend) {
+			defer wg.Done()
+			err := x.probe(ctx, b)
+			if err != nil {
+				logger.WithError(err).WithField("backend", b.Name).Warn("Backend is unreachable")
+			}
+
+			x.mutex.Lock()
+			x.results[b.Name] = &probeResult{err: err, checkedAt: time.Now()}
+			x.mutex.Unlock()
+
+			mutex.Lock()
+			results[b.Name] = err
+			mutex.Unlock()
+		}(b)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// readiness checks that the server can serve searches: not shutting down,
+// authz table is loaded and at least one backend is reachable.
+type readiness struct {
+	state *serverState
+	authz *authzHolder
+	probe *backendProbe
+}
+
+func (x *readiness) check(ctx context.Context) (bool, gin.H) {
+	ready := true
+	checks := gin.H{}
+	report := func(name string, ok bool) {
+		if ok {
+			checks[name] = checkOK
+		} else {
+			checks[name] = checkNotReady
+			ready = false
+		}
+	}
+
+	report("server", x.state.ready())
+	report("authz", x.authz.get() != nil)
+
+	// Errors are logged by probe and not returned to clients
+	backends := gin.H{}
+	reachable := false
+	for name, err := range x.probe.check(ctx) {
+		if err != nil {
+			backends[name] = checkFail
+		} else {
+			backends[name] = checkOK
+			reachable = true
+		}
+	}
+	checks["minerva"] = backends
+	if !reachable {
+		ready = false
+	}
+
+	return ready, checks
+}
+
+func setupHealth(ready *readiness, r *gin.Engine) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": checkOK})
+	})
+
+	r.GET("/readyz", func(c *gin.Context) {
+		ok, checks := ready.check(c.Request.Context())
+		if !ok {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": checkNotReady, "checks": checks})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": checkOK, "checks": checks})
+	})
+
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, getVersionInfo())
+	})
+}
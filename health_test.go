@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getJSON(t *testing.T, url string) (int, map[string]interface{}) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+func TestHealth(t *testing.T) {
+	var calls, down int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: upstream.URL + "/prod", APIKey: "tokyo-key"},
+		},
+	})
+	require.NoError(t, err)
+
+	srv, err := main.NewAuthzService([]byte(`{"roles":[],"users":[]}`))
+	require.NoError(t, err)
+	holder := main.NewAuthzHolder(srv, false)
+
+	newServer := func(state *main.ServerState, ttl time.Duration) *httptest.Server {
+		s := httptest.NewServer(main.NewHealthHandler(state, holder, router, ttl))
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	t.Run("healthz and version", func(t *testing.T) {
+		s := newServer(&main.ServerState{}, time.Minute)
+
+		status, body := getJSON(t, s.URL+"/healthz")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "ok", body["status"])
+
+		status, body = getJSON(t, s.URL+"/version")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, runtime.Version(), body["go_version"])
+		assert.Contains(t, body, "git_commit")
+		assert.Contains(t, body, "build_time")
+	})
+
+	t.Run("ready with cached probe", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		s := newServer(&main.ServerState{}, time.Minute)
+
+		for i := 0; i < 3; i++ {
+			status, body := getJSON(t, s.URL+"/readyz")
+			assert.Equal(t, http.StatusOK, status)
+			checks := body["checks"].(map[string]interface{})
+			assert.Equal(t, "ok", checks["authz"])
+			assert.NotContains(t, checks, "session")
+			assert.Equal(t, map[string]interface{}{"tokyo": "ok"}, checks["minerva"])
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Minerva is unreachable", func(t *testing.T) {
+		atomic.StoreInt32(&down, 1)
+		defer atomic.StoreInt32(&down, 0)
+		s := newServer(&main.ServerState{}, 0)
+
+		status, body := getJSON(t, s.URL+"/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		checks := body["checks"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"tokyo": "fail"}, checks["minerva"])
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		state := &main.ServerState{}
+		main.DrainServer(state)
+		s := newServer(state, time.Minute)
+
+		status, body := getJSON(t, s.URL+"/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, "not_ready", body["checks"].(map[string]interface{})["server"])
+	})
+}
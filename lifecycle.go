@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// serverState is readiness of the server. The server becomes not ready at
+// first of shutdown so that load balancers stop sending new requests before
+// listeners are closed.
+type serverState struct {
+	draining int32
+}
+
+func (x *serverState) ready() bool {
+	return atomic.LoadInt32(&x.draining) == 0
+}
+
+func (x *serverState) drain() {
+	atomic.StoreInt32(&x.draining, 1)
+}
+
+// closeWhileDraining asks keep-alive clients to reconnect, hopefully to
+// another replica, while the server is draining.
+func (x *serverState) closeWhileDraining(c *gin.Context) {
+	if !x.ready() {
+		c.Header("Connection", "close")
+	}
+	c.Next()
+}
+
+// serve serves handler by HTTPS if certificate is given, otherwise by HTTP,
+// until ctx is canceled. Then the server becomes not ready, waits for delay,
+// stops accepting new connections and drains active requests within timeout.
+func serve(ctx context.Context, args arguments, handler http.Handler, state *serverState) error {
+	addr := net.JoinHostPort(args.BindAddress, strconv.Itoa(args.BindPort))
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: args.ReadHeaderTimeout}
+	servers := []*http.Server{server}
+	errCh := make(chan error, 2)
+
+	if args.serveTLS() {
+		config, err := newServerTLSConfig(args)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = config
+
+		if args.HTTPRedirectPort > 0 {
+			redirect := &http.Server{
+				Addr:              net.JoinHostPort(args.BindAddress, strconv.Itoa(args.HTTPRedirectPort)),
+				Handler:           redirectHTTPS(args.BindPort),
+				ReadHeaderTimeout: args.ReadHeaderTimeout,
+			}
+			servers = append(servers, redirect)
+
+			logger.WithField("addr", redirect.Addr).Info("Listening HTTP to redirect HTTPS")
+			go func() { errCh <- redirect.ListenAndServe() }()
+		}
+
+		logger.WithFields(logrus.Fields{
+			"addr":        addr,
+			"client_auth": args.TLSClientAuth,
+		}).Info("Listening HTTPS")
+		go func() { errCh <- server.ListenAndServeTLS("", "") }()
+	} else {
+		logger.WithField("addr", addr).Info("Listening HTTP")
+		go func() { errCh <- server.ListenAndServe() }()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.WithFields(logrus.Fields{
+		"delay":   args.ShutdownDelay.String(),
+		"timeout": args.ShutdownTimeout.String(),
+	}).Info("Shutting down, readiness is turned off")
+	state.drain()
+	time.Sleep(args.ShutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), args.ShutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.Shutdown(drainCtx); err != nil {
+			logger.WithError(err).WithField("addr", s.Addr).Warn("Fail to drain requests in time, close remaining connections")
+			s.Close()
+		}
+	}
+
+	logger.Info("Server stopped")
+	return nil
+}
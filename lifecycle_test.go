@@ -0,0 +1,124 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves a handler responding after wait and returns base URL.
+func startServer(t *testing.T, ctx context.Context, args main.Arguments, wait time.Duration, state *main.ServerState) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	args.BindAddress, args.BindPort = "127.0.0.1", port
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(wait)
+		w.Write([]byte("done"))
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- main.Serve(ctx, args, handler, state) }()
+
+	baseURL := "http://127.0.0.1:" + strconv.Itoa(port)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	return baseURL, done
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &main.ServerState{}
+	baseURL, done := startServer(t, ctx, main.Arguments{ShutdownTimeout: 5 * time.Second}, 300*time.Millisecond, state)
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(baseURL + "/api/v1/search/s1/logs")
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, main.ServerReady(state))
+	cancel()
+
+	// Active request is drained
+	r := <-inFlight
+	require.NoError(t, r.err)
+	assert.Equal(t, "done", r.body)
+	require.NoError(t, <-done)
+	assert.False(t, main.ServerReady(state))
+
+	// New connection is refused
+	_, err := http.Get(baseURL)
+	assert.Error(t, err)
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	baseURL, done := startServer(t, ctx, main.Arguments{ShutdownTimeout: 50 * time.Millisecond}, 2*time.Second, &main.ServerState{})
+
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(baseURL)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Server is not stopped after shutdown timeout")
+	}
+	assert.Error(t, <-inFlight)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	baseURL, _ := startServer(t, ctx, main.Arguments{ReadHeaderTimeout: 50 * time.Millisecond}, 0, &main.ServerState{})
+
+	// Connection sending header slowly is closed
+	conn, err := net.Dial("tcp", strings.TrimPrefix(baseURL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: strix\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ioutil.ReadAll(conn)
+	require.NoError(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -41,6 +42,17 @@ func main() {
 	}
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "config, c",
+			Usage:       "Config file (YAML or TOML) of options, keys are names of options. Flags and environment variables take precedence",
+			EnvVar:      "STRIX_CONFIG",
+			Destination: &args.ConfigPath,
+		},
+		cli.StringFlag{
+			Name:        "endpoint",
+			Usage:       "Endpoint URL of Minerva, same as endpoint argument",
+			Destination: &args.Endpoint,
+		},
 		cli.StringFlag{
 			Name: "log-level, l", Value: "info",
 			Usage:       "Log level [trace,debug,info,warn,error]",
@@ -57,10 +69,85 @@ func main() {
 			Destination: &args.BindPort,
 		},
 		cli.StringFlag{
-			Name: "static, s", Value: "./static",
-			Usage:       "Static contents path",
+			Name:        "tls-cert",
+			Usage:       "Server certificate (PEM) to serve HTTPS, reloaded on change",
+			Destination: &args.TLSCert,
+		},
+		cli.StringFlag{
+			Name:        "tls-key",
+			Usage:       "Private key (PEM) of server certificate",
+			Destination: &args.TLSKey,
+		},
+		cli.StringFlag{
+			Name:        "tls-min-version",
+			Usage:       "Minimum TLS version of HTTPS [1.0,1.1,1.2,1.3] (default: 1.2)",
+			Destination: &args.TLSMinVersion,
+		},
+		cli.StringFlag{
+			Name: "tls-client-auth", Value: clientAuthNone,
+			Usage:       "Client certificate verification [none,optional,require], a verified certificate is accepted as user identity",
+			Destination: &args.TLSClientAuth,
+		},
+		cli.StringFlag{
+			Name:        "tls-client-ca",
+			Usage:       "CA bundle (PEM) to verify client certificates",
+			Destination: &args.TLSClientCA,
+		},
+		cli.IntFlag{
+			Name:        "http-redirect-port",
+			Usage:       "Port of HTTP listener redirecting to HTTPS (0 disables)",
+			Destination: &args.HTTPRedirectPort,
+		},
+		cli.DurationFlag{
+			Name: "read-header-timeout", Value: 10 * time.Second,
+			Usage:       "Timeout to read request header from clients (0 disables)",
+			Destination: &args.ReadHeaderTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-delay",
+			Usage:       "Wait after turning off readiness before closing listeners at shutdown, e.g. longer than readiness probe interval",
+			Destination: &args.ShutdownDelay,
+		},
+		cli.DurationFlag{
+			Name: "shutdown-timeout", Value: 30 * time.Second,
+			Usage:       "Deadline to drain active requests at shutdown",
+			Destination: &args.ShutdownTimeout,
+		},
+		cli.StringFlag{
+			Name: "trace-exporter", Value: traceExporterNone,
+			Usage:       "Exporter of trace spans [none|otlp|stdout]",
+			Destination: &args.TraceExporter,
+		},
+		cli.StringFlag{
+			Name:        "trace-endpoint",
+			Usage:       "OTLP/HTTP endpoint of traces, e.g. http://localhost:4318 (default: OTEL_EXPORTER_OTLP_ENDPOINT)",
+			Destination: &args.TraceEndpoint,
+		},
+		cli.StringFlag{
+			Name:        "trace-file",
+			Usage:       "File to write spans by stdout exporter instead of stdout",
+			Destination: &args.TraceFile,
+		},
+		cli.Float64Flag{
+			Name: "trace-sample-ratio", Value: 1.0,
+			Usage:       "Ratio of sampled traces without sampled parent",
+			Destination: &args.TraceSampleRatio,
+		},
+		cli.DurationFlag{
+			Name: "readiness-cache-ttl", Value: 10 * time.Second,
+			Usage:       "TTL of cached reachability of Minerva checked by /readyz",
+			Destination: &args.ReadinessCacheTTL,
+		},
+		cli.StringFlag{
+			Name:        "static, s",
+			Usage:       "Static contents path to serve web UI from instead of embedded one, for development",
 			Destination: &args.StaticContents,
 		},
+		cli.StringFlag{
+			Name: "base-path", Value: "/",
+			Usage:       "Path prefix of web UI, auth and API routes to run behind a shared ingress, e.g. /strix/",
+			Destination: &args.BasePath,
+		},
 		cli.StringFlag{
 			Name: "hello-reply, r", Value: time.Now().String(),
 			Usage:       "Reply message for /hello/revision",
@@ -84,25 +171,283 @@ func main() {
 			EnvVar:      "JWT_SECRET",
 			Destination: &args.JWTSecret,
 		},
+		cli.StringFlag{
+			Name: "cookie-secret", Value: "auth",
+			Usage:       "Key to sign session cookie",
+			EnvVar:      "COOKIE_SECRET",
+			Destination: &args.CookieSecret,
+		},
+		cli.StringFlag{
+			Name:        "cookie-domain",
+			Usage:       "Domain attribute of session cookie (default: host of the request)",
+			Destination: &args.CookieDomain,
+		},
+		cli.BoolFlag{
+			Name:        "cookie-secure",
+			Usage:       "Send session cookie only over HTTPS",
+			Destination: &args.CookieSecure,
+		},
+		cli.StringFlag{
+			Name:        "group-resolver-url",
+			Usage:       "HTTP endpoint to resolve group memberships of a user at login",
+			Destination: &args.GroupResolverURL,
+		},
+		cli.StringFlag{
+			Name:        "scim-token",
+			Usage:       "Bearer token of SCIM provisioning endpoint (/scim/v2), SCIM is disabled if not set",
+			EnvVar:      "SCIM_TOKEN",
+			Destination: &args.SCIMToken,
+		},
+		cli.StringFlag{
+			Name:        "scim-store",
+			Usage:       "File path to save users and groups provisioned via SCIM",
+			Destination: &args.SCIMStorePath,
+		},
 		cli.StringFlag{
 			Name:        "api-key, k",
 			Usage:       "API Key of Minerva",
 			EnvVar:      "API_KEY",
 			Destination: &args.APIKey,
 		},
+		cli.StringFlag{
+			Name:        "api-key-file",
+			Usage:       "File of Minerva API keys (primary key in the 1st line, secondary key in the 2nd line) or directory having \"primary\" and \"secondary\" files, reloaded on change",
+			EnvVar:      "API_KEY_FILE",
+			Destination: &args.APIKeyFile,
+		},
+		cli.DurationFlag{
+			Name: "api-key-reload-interval", Value: 30 * time.Second,
+			Usage:       "Interval to check change of API key file (0 disables reload)",
+			Destination: &args.APIKeyReloadInterval,
+		},
+		cli.StringFlag{
+			Name:        "backends",
+			Usage:       "Config file (JSON or YAML) of named Minerva backends and routes, endpoint argument is optional if set",
+			Destination: &args.BackendsPath,
+		},
+		cli.StringFlag{
+			Name: "upstream-auth", Value: "api_key",
+			Usage:       "Authentication to Minerva [api_key,sigv4], sigv4 uses AWS credentials from environment, shared credentials file or instance role",
+			Destination: &args.UpstreamAuth,
+		},
+		cli.StringFlag{
+			Name:        "aws-region",
+			Usage:       "AWS region of Minerva API Gateway for SigV4 signing (default: region of AWS config)",
+			Destination: &args.AWSRegion,
+		},
+		cli.StringFlag{
+			Name:        "aws-role-arn",
+			Usage:       "IAM role to assume for SigV4 signing",
+			Destination: &args.AWSRoleARN,
+		},
+		cli.StringFlag{
+			Name:        "upstream-ca",
+			Usage:       "CA bundle (PEM) to verify Minerva endpoint",
+			Destination: &args.UpstreamCA,
+		},
+		cli.StringFlag{
+			Name:        "upstream-cert",
+			Usage:       "Client certificate (PEM) for Minerva endpoint, reloaded on change",
+			Destination: &args.UpstreamCert,
+		},
+		cli.StringFlag{
+			Name:        "upstream-key",
+			Usage:       "Private key (PEM) of client certificate for Minerva endpoint",
+			Destination: &args.UpstreamKey,
+		},
+		cli.StringFlag{
+			Name:        "upstream-server-name",
+			Usage:       "Server name (SNI) to verify Minerva endpoint instead of host of the endpoint",
+			Destination: &args.UpstreamServerName,
+		},
+		cli.StringFlag{
+			Name:        "upstream-tls-min-version",
+			Usage:       "Minimum TLS version of connection to Minerva [1.0,1.1,1.2,1.3] (default: 1.2)",
+			Destination: &args.UpstreamTLSMinVersion,
+		},
+		cli.StringFlag{
+			Name:        "upstream-proxy",
+			Usage:       "HTTP proxy URL to connect Minerva (default: HTTPS_PROXY environment variable)",
+			Destination: &args.UpstreamProxy,
+		},
+		cli.DurationFlag{
+			Name: "upstream-dial-timeout", Value: 5 * time.Second,
+			Usage:       "Timeout to connect Minerva (0 disables)",
+			Destination: &args.UpstreamDialTimeout,
+		},
+		cli.DurationFlag{
+			Name: "upstream-header-timeout", Value: 30 * time.Second,
+			Usage:       "Timeout to wait for response header of Minerva (0 disables)",
+			Destination: &args.UpstreamHeaderTimeout,
+		},
+		cli.DurationFlag{
+			Name: "upstream-timeout", Value: time.Minute,
+			Usage:       "Total timeout of a request to Minerva including retries until response header (0 disables)",
+			Destination: &args.UpstreamTimeout,
+		},
+		cli.IntFlag{
+			Name: "upstream-retries", Value: 2,
+			Usage:       "Max retries of GET requests to Minerva failed by network error or 502/503/504",
+			Destination: &args.UpstreamRetries,
+		},
+		cli.DurationFlag{
+			Name: "upstream-retry-backoff", Value: 200 * time.Millisecond,
+			Usage:       "Base wait before retry, doubled for each retry with jitter",
+			Destination: &args.UpstreamRetryBackoff,
+		},
+		cli.IntFlag{
+			Name: "circuit-breaker-failures", Value: 5,
+			Usage:       "Consecutive failures of a backend to open circuit breaker (0 disables)",
+			Destination: &args.CircuitBreakerFailures,
+		},
+		cli.DurationFlag{
+			Name: "circuit-breaker-cooldown", Value: 30 * time.Second,
+			Usage:       "Wait before a trial request to a backend with open circuit breaker",
+			Destination: &args.CircuitBreakerCooldown,
+		},
 		cli.StringFlag{
 			Name:        "authz-path, z",
-			Usage:       "Authorization list json file path",
+			Usage:       "Authorization list file (JSON or YAML), directory, glob pattern or HTTP(S) URL",
 			Destination: &args.AuthzFilePath,
 		},
+		cli.DurationFlag{
+			Name: "authz-poll-interval", Value: time.Minute,
+			Usage:       "Polling interval of authorization list URL (0 disables polling)",
+			Destination: &args.AuthzPollInterval,
+		},
+		cli.StringFlag{
+			Name:        "authz-pubkey",
+			Usage:       "Ed25519 public key file to verify detached signature (<URL>.sig) of authorization list",
+			Destination: &args.AuthzPublicKey,
+		},
+		cli.BoolFlag{
+			Name:        "authz-fail-closed",
+			Usage:       "Reject all requests when authorization list URL can not be refreshed, instead of keeping the last one",
+			Destination: &args.AuthzFailClosed,
+		},
+		cli.StringFlag{
+			Name:        "audit-file",
+			Usage:       "Audit log file path",
+			Destination: &args.AuditFilePath,
+		},
+		cli.IntFlag{
+			Name: "audit-file-max-size", Value: 100,
+			Usage:       "Max size of audit log file in MB before rotation (0 disables rotation)",
+			Destination: &args.AuditFileMaxSize,
+		},
+		cli.IntFlag{
+			Name: "audit-file-max-backups", Value: 10,
+			Usage:       "Number of rotated audit log files to keep (0 keeps all)",
+			Destination: &args.AuditFileMaxBackups,
+		},
+		cli.StringFlag{
+			Name:        "audit-syslog",
+			Usage:       "Syslog destination of audit log, \"local\" or URL such as udp://host:514",
+			Destination: &args.AuditSyslog,
+		},
+		cli.StringFlag{
+			Name:        "audit-webhook",
+			Usage:       "HTTP endpoint to send audit log as NDJSON",
+			Destination: &args.AuditWebhook,
+		},
+		cli.BoolFlag{
+			Name:        "anomaly-detection",
+			Usage:       "Enable alerts on unusual search activity learned from audit log",
+			Destination: &args.AnomalyDetection,
+		},
+		cli.StringFlag{
+			Name:        "anomaly-webhook",
+			Usage:       "HTTP endpoint to send anomaly alerts as JSON (alerts are logged if not set)",
+			Destination: &args.AnomalyWebhook,
+		},
+		cli.StringFlag{
+			Name:        "anomaly-sensitive-tags",
+			Usage:       "Comma separated tag patterns to alert at first access by each user, e.g. \"hr.*,payroll\"",
+			Destination: &args.AnomalySensitiveTags,
+		},
+		cli.Float64Flag{
+			Name: "anomaly-spike-factor", Value: 3,
+			Usage:       "Alert when hourly searches exceed the baseline by this many standard deviations",
+			Destination: &args.AnomalySpikeFactor,
+		},
+		cli.IntFlag{
+			Name: "anomaly-bulk-pages", Value: 20,
+			Usage:       "Alert when this many result pages of a search are fetched in 10 minutes (0 disables)",
+			Destination: &args.AnomalyBulkPages,
+		},
+		cli.Float64Flag{
+			Name:        "rate-limit",
+			Usage:       "Max API requests per minute of each user (0 disables), overridden by rate_limit of role",
+			Destination: &args.RateLimit,
+		},
+		cli.IntFlag{
+			Name:        "rate-limit-burst",
+			Usage:       "Burst size of rate limit (default is same as --rate-limit)",
+			Destination: &args.RateLimitBurst,
+		},
+		cli.IntFlag{
+			Name:        "max-concurrent-searches",
+			Usage:       "Max running searches of each user (0 disables), overridden by rate_limit of role",
+			Destination: &args.MaxConcurrentSearches,
+		},
+		cli.DurationFlag{
+			Name: "cache-ttl", Value: 5 * time.Minute,
+			Usage:       "TTL of cached results of completed searches (0 disables cache)",
+			Destination: &args.CacheTTL,
+		},
+		cli.IntFlag{
+			Name: "cache-size", Value: 256,
+			Usage:       "Max total size of cached results in MB",
+			Destination: &args.CacheSize,
+		},
+		cli.DurationFlag{
+			Name:        "search-dedup-window",
+			Usage:       "Return existing search ID for an identical query with same permitted tags created within the window, e.g. 10m (0 disables)",
+			Destination: &args.SearchDedupWindow,
+		},
 	}
 	app.ArgsUsage = "[endpoint]"
 
+	opts := newOptions(app)
+	app.Before = func(c *cli.Context) error {
+		return opts.load(c, args.ConfigPath)
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "audit-verify",
+			Usage:     "Verify hash chain of audit log files (pass rotated files from the oldest)",
+			ArgsUsage: "FILE [FILE...]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return fmt.Errorf("audit log file is required")
+				}
+				logger.SetFormatter(&logrus.JSONFormatter{})
+				return verifyAuditFiles(c.Args())
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Show configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:  "print",
+					Usage: "Print effective options merged from flags, environment variables and config file with their sources, secrets are redacted",
+					Action: func(c *cli.Context) error {
+						return opts.print(os.Stdout)
+					},
+				},
+			},
+		},
+	}
+
 	app.Action = func(c *cli.Context) error {
-		if c.NArg() != 1 {
+		if c.NArg() > 1 || (c.NArg() == 0 && args.Endpoint == "" && args.BackendsPath == "") {
 			return fmt.Errorf("endpoint is required")
 		}
-		args.Endpoint = c.Args().Get(0)
+		if c.NArg() == 1 {
+			args.Endpoint = c.Args().Get(0)
+		}
 
 		if err := runServer(args); err != nil {
 			return err
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels of metrics must be bounded, i.e. route patterns, backend names,
+// role names and fixed categories. User IDs and search IDs are never used.
+var (
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "strix_logins_total",
+		Help: "Login attempts by provider and outcome",
+	}, []string{"provider", "outcome"})
+
+	metricAuthnFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "strix_authn_failures_total",
+		Help: "Failures of session validation by reason",
+	}, []string{"reason"})
+
+	metricAuthzDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "strix_authz_denials_total",
+		Help: "Denied API requests by role of the user and reason",
+	}, []string{"role", "reason"})
+
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "strix_api_request_duration_seconds",
+		Help:    "Latency of API requests by route, status and backend",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"route", "method", "status", "backend"})
+
+	metricResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "strix_api_response_bytes_total",
+		Help: "Bytes of API responses by route and backend",
+	}, []string{"route", "backend"})
+
+	metricCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "strix_cache_requests_total",
+		Help: "Requests by result of response cache and search dedup (hit, miss, shared, dedup, bypass)",
+	}, []string{"route", "result"})
+
+	metricUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "strix_upstream_request_duration_seconds",
+		Help:    "Latency of each request attempt to Minerva by backend and status",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"backend", "method", "status"})
+)
+
+// authnFailureReason categorizes an error message of session validation.
+func authnFailureReason(reason string) string {
+	switch {
+	case strings.HasPrefix(reason, "no cookie"):
+		return "no_session"
+	case strings.Contains(reason, "expired"), strings.HasPrefix(reason, "Timing is everything"):
+		return "expired"
+	case strings.Contains(reason, "token"), strings.Contains(reason, "cookie"):
+		return "invalid_token"
+	default:
+		return "other"
+	}
+}
+
+// authzDenialReason categorizes reason of a denied request.
+func authzDenialReason(reason string) string {
+	switch {
+	case reason == "Unauthorized user":
+		return "unauthorized_user"
+	case reason == "Rate limit exceeded":
+		return "rate_limit"
+	case reason == "Too many running searches":
+		return "concurrent_searches"
+	case strings.HasPrefix(reason, errBackendForbidden.Error()):
+		return "backend_forbidden"
+	case strings.HasPrefix(reason, errBackendNotFound.Error()):
+		return "backend_not_found"
+	default:
+		return "other"
+	}
+}
+
+// metricsObserver counts audit events of authentication and authorization.
+type metricsObserver struct{}
+
+func (x *metricsObserver) observe(ev *auditEvent) {
+	switch {
+	case ev.Type == auditLogin:
+		metricLogins.WithLabelValues(ev.Provider, ev.Outcome).Inc()
+
+	case ev.Type == auditAuthn && ev.Outcome == auditDeny:
+		metricAuthnFailures.WithLabelValues(authnFailureReason(ev.Reason)).Inc()
+
+	case ev.Outcome == auditDeny:
+		reason := authzDenialReason(ev.Reason)
+		if len(ev.Roles) == 0 {
+			metricAuthzDenials.WithLabelValues("none", reason).Inc()
+		}
+		for _, role := range ev.Roles {
+			metricAuthzDenials.WithLabelValues(role, reason).Inc()
+		}
+	}
+}
+
+// metricsMiddleware records latency, size and cache result of API requests.
+// Route is the registered pattern, e.g. /api/v1/search/:search_id/logs.
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	backend := c.GetString("backend")
+
+	metricRequestDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status()), backend).Observe(time.Since(start).Seconds())
+	if size := c.Writer.Size(); size > 0 {
+		metricResponseBytes.WithLabelValues(route, backend).Add(float64(size))
+	}
+	if result := c.Writer.Header().Get("X-Strix-Cache"); result != "" {
+		metricCacheRequests.WithLabelValues(route, result).Inc()
+	}
+}
+
+func observeUpstream(backend, method string, status int, err error, elapsed time.Duration) {
+	label := strconv.Itoa(status)
+	if err != nil {
+		label = "error"
+	}
+	metricUpstreamDuration.WithLabelValues(backend, method, label).Observe(elapsed.Seconds())
+}
+
+// runningSearchCounter is implemented by a rate limit store able to count
+// running searches of each user.
+type runningSearchCounter interface {
+	runningSearches(now time.Time) map[string]int
+}
+
+// activeSearchCollector exports number of running searches and number of
+// users by count of their running searches, instead of per user series.
+type activeSearchCollector struct {
+	store runningSearchCounter
+
+	searches *prometheus.Desc
+	users    *prometheus.Desc
+}
+
+// activeSearchBuckets are values of "searches" label of users metric. The
+// last one includes more searches.
+var activeSearchBuckets = []string{"1", "2", "3", "4", "5+"}
+
+func newActiveSearchCollector(store runningSearchCounter) *activeSearchCollector {
+	return &activeSearchCollector{
+		store: store,
+		searches: prometheus.NewDesc("strix_active_searches",
+			"Running searches of all users", nil, nil),
+		users: prometheus.NewDesc("strix_active_search_users",
+			"Users by number of their running searches", []string{"searches"}, nil),
+	}
+}
+
+func (x *activeSearchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- x.searches
+	ch <- x.users
+}
+
+func (x *activeSearchCollector) Collect(ch chan<- prometheus.Metric) {
+	total := 0
+	users := make([]int, len(activeSearchBuckets))
+	for _, n := range x.store.runningSearches(time.Now()) {
+		if n == 0 {
+			continue
+		}
+		total += n
+		if n > len(users) {
+			n = len(users)
+		}
+		users[n-1]++
+	}
+
+	ch <- prometheus.MustNewConstMetric(x.searches, prometheus.GaugeValue, float64(total))
+	for i, label := range activeSearchBuckets {
+		ch <- prometheus.MustNewConstMetric(x.users, prometheus.GaugeValue, float64(users[i]), label)
+	}
+}
+
+// setupMetrics registers metrics and serves them at /metrics.
+func setupMetrics(audit *auditLogger, limiter *rateLimiter, r *gin.Engine) error {
+	registry := prometheus.NewRegistry()
+	metrics := []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricLogins,
+		metricAuthnFailures,
+		metricAuthzDenials,
+		metricRequestDuration,
+		metricResponseBytes,
+		metricCacheRequests,
+		metricUpstreamDuration,
+	}
+	if counter, ok := limiter.store.(runningSearchCounter); ok {
+		metrics = append(metrics, newActiveSearchCollector(counter))
+	}
+
+	for _, c := range metrics {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	audit.subscribe(&metricsObserver{})
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	return nil
+}
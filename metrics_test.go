@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			w.Write([]byte(`{"search_id":"0d5c1b2e-secret-search"}`))
+			return
+		}
+		w.Write([]byte(`{"metadata":{"status":"RUNNING"}}`))
+	}))
+	defer upstream.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: upstream.URL, APIKey: "tokyo-key"},
+		},
+	})
+	require.NoError(t, err)
+
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name": "analyst", "permitted_tags": ["web"]}],
+		"users": [{"user_id": "blue@example.com", "role": "analyst"}]
+	}`))
+	require.NoError(t, err)
+
+	handler, audit := main.NewMetricsServer(main.NewAuthzHolder(srv, false), router)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	do := func(method, path, user string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(`{"query":[]}`))
+		require.NoError(t, err)
+		req.Header.Set("X-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	do(http.MethodPost, "/api/v1/search", "blue@example.com")
+	do(http.MethodGet, "/api/v1/search/0d5c1b2e-secret-search", "blue@example.com")
+	do(http.MethodPost, "/api/v1/search?backend=nowhere", "blue@example.com")
+	do(http.MethodPost, "/api/v1/search", "orange@example.com")
+	main.AuditLog(audit, main.NewAuthnDenyEvent("Token is already expired: 2026-01-01"))
+
+	resp, err := http.Get(s.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(raw)
+
+	for _, line := range []string{
+		`strix_api_request_duration_seconds_count{backend="tokyo",method="POST",route="/api/v1/search",status="200"} 1`,
+		`strix_api_request_duration_seconds_count{backend="tokyo",method="GET",route="/api/v1/search/:search_id",status="200"} 1`,
+		`strix_cache_requests_total{result="miss",route="/api/v1/search/:search_id"} 1`,
+		// Upstream requests are also counted by other tests
+		`strix_upstream_request_duration_seconds_count{backend="tokyo",method="POST",status="200"}`,
+		`strix_authz_denials_total{reason="backend_not_found",role="analyst"} 1`,
+		`strix_authz_denials_total{reason="unauthorized_user",role="none"} 1`,
+		`strix_authn_failures_total{reason="expired"} 1`,
+		`strix_active_searches 1`,
+		`strix_active_search_users{searches="1"} 1`,
+	} {
+		assert.Contains(t, metrics, line)
+	}
+
+	// No unbounded labels
+	assert.NotContains(t, metrics, "example.com")
+	assert.NotContains(t, metrics, "secret-search")
+}
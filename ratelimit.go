@@ -0,0 +1,297 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// runningSearchTTL is the max lifetime of a running search slot in case
+	// a client never fetches the final status of the search.
+	runningSearchTTL = 30 * time.Minute
+
+	// concurrentRetryAfter is the wait time suggested to a client exceeding
+	// the concurrent search limit.
+	concurrentRetryAfter = 5 * time.Second
+
+	// searchStatusRunning is status of a search not completed in Minerva.
+	searchStatusRunning = "RUNNING"
+)
+
+// rateLimit is a token bucket of API requests and a cap of running searches
+// for each user. Zero value of a field means no limit.
+type rateLimit struct {
+	PerMinute     float64 `json:"per_minute" yaml:"per_minute"`
+	Burst         int     `json:"burst" yaml:"burst"`
+	MaxConcurrent int     `json:"max_concurrent_searches" yaml:"max_concurrent_searches"`
+}
+
+// merge returns the more permissive limit of each field. Fields not set are
+// taken from the other.
+func (x *rateLimit) merge(other *rateLimit) *rateLimit {
+	if x == nil {
+		return other
+	}
+	if other == nil {
+		return x
+	}
+
+	return &rateLimit{
+		PerMinute:     math.Max(x.PerMinute, other.PerMinute),
+		Burst:         maxInt(x.Burst, other.Burst),
+		MaxConcurrent: maxInt(x.MaxConcurrent, other.MaxConcurrent),
+	}
+}
+
+// override returns x with fields replaced by fields set in other.
+func (x rateLimit) override(other *rateLimit) rateLimit {
+	if other == nil {
+		return x
+	}
+	if other.PerMinute > 0 {
+		x.PerMinute, x.Burst = other.PerMinute, other.Burst
+	}
+	if other.Burst > 0 {
+		x.Burst = other.Burst
+	}
+	if other.MaxConcurrent > 0 {
+		x.MaxConcurrent = other.MaxConcurrent
+	}
+	return x
+}
+
+// burst returns bucket size. It's same as rate per minute if not set.
+func (x rateLimit) burst() float64 {
+	if x.Burst > 0 {
+		return float64(x.Burst)
+	}
+	return math.Max(1, math.Ceil(x.PerMinute))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// rateLimitStore keeps state of rate limits. Keys are user IDs. State is kept
+// in memory by default and can be replaced by a shared store, e.g. to run
+// multiple replicas.
+type rateLimitStore interface {
+	// take consumes a token of the bucket. It returns time to wait for the
+	// next token if no token is left.
+	take(key string, limit rateLimit, now time.Time) (time.Duration, error)
+
+	// acquire registers a running search as id if number of running searches
+	// is less than max.
+	acquire(key, id string, max int, now time.Time) (bool, error)
+
+	// rename replaces id of a running search, e.g. from request ID to search
+	// ID assigned by Minerva.
+	rename(key, oldID, newID string) error
+
+	// release removes a running search.
+	release(key, id string) error
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	running map[string]map[string]time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: map[string]*tokenBucket{},
+		running: map[string]map[string]time.Time{},
+	}
+}
+
+func (x *memoryRateLimitStore) take(key string, limit rateLimit, now time.Time) (time.Duration, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	burst := limit.burst()
+	b, ok := x.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		x.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Minutes()*limit.PerMinute)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+
+	wait := (1 - b.tokens) / limit.PerMinute * float64(time.Minute)
+	return time.Duration(wait), nil
+}
+
+func (x *memoryRateLimitStore) acquire(key, id string, max int, now time.Time) (bool, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	searches, ok := x.running[key]
+	if !ok {
+		searches = map[string]time.Time{}
+		x.running[key] = searches
+	}
+
+	for searchID, expiresAt := range searches {
+		if now.After(expiresAt) {
+			delete(searches, searchID)
+		}
+	}
+
+	if len(searches) >= max {
+		return false, nil
+	}
+
+	searches[id] = now.Add(runningSearchTTL)
+	return true, nil
+}
+
+// runningSearches returns number of running searches of each user.
+func (x *memoryRateLimitStore) runningSearches(now time.Time) map[string]int {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	counts := map[string]int{}
+	for key, searches := range x.running {
+		for _, expiresAt := range searches {
+			if !now.After(expiresAt) {
+				counts[key]++
+			}
+		}
+	}
+	return counts
+}
+
+func (x *memoryRateLimitStore) rename(key, oldID, newID string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if expiresAt, ok := x.running[key][oldID]; ok {
+		delete(x.running[key], oldID)
+		x.running[key][newID] = expiresAt
+	}
+	return nil
+}
+
+func (x *memoryRateLimitStore) release(key, id string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if searches, ok := x.running[key]; ok {
+		delete(searches, id)
+		if len(searches) == 0 {
+			delete(x.running, key)
+		}
+	}
+	return nil
+}
+
+// rateLimiter applies default limit of each user or limit of the user's
+// role. Errors of the store are logged and the request is allowed not to
+// stop searches by failure of the store.
+type rateLimiter struct {
+	store    rateLimitStore
+	defaults rateLimit
+}
+
+func newRateLimiter(store rateLimitStore, defaults rateLimit) *rateLimiter {
+	return &rateLimiter{store: store, defaults: defaults}
+}
+
+func (x *rateLimiter) limitOf(user *authzUser) rateLimit {
+	return x.defaults.override(user.rateLimit())
+}
+
+// allow consumes a token of the user. It returns false and time to wait if
+// the user exceeds the rate limit.
+func (x *rateLimiter) allow(userID string, limit rateLimit) (bool, time.Duration) {
+	if limit.PerMinute <= 0 {
+		return true, 0
+	}
+
+	wait, err := x.store.take(userID, limit, time.Now())
+	if err != nil {
+		logger.WithError(err).WithField("user", userID).Error("Fail to check rate limit")
+		return true, 0
+	}
+	return wait == 0, wait
+}
+
+// startSearch reserves a slot of running search by request ID. It returns
+// false if the user already has max running searches. Running searches are
+// tracked without the limit too for metrics.
+func (x *rateLimiter) startSearch(userID, reqID string, limit rateLimit) bool {
+	max := limit.MaxConcurrent
+	if max <= 0 {
+		max = math.MaxInt32
+	}
+
+	ok, err := x.store.acquire(userID, reqID, max, time.Now())
+	if err != nil {
+		logger.WithError(err).WithField("user", userID).Error("Fail to check concurrent searches")
+		return true
+	}
+	return ok
+}
+
+// searchCreated binds the reserved slot to the search ID, or releases it if
+// the search is not created.
+func (x *rateLimiter) searchCreated(userID, reqID, searchID string) {
+	var err error
+	if searchID == "" {
+		err = x.store.release(userID, reqID)
+	} else {
+		err = x.store.rename(userID, reqID, searchID)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("user", userID).Error("Fail to update running searches")
+	}
+}
+
+// searchStatus releases the slot when the search is completed.
+func (x *rateLimiter) searchStatus(userID, searchID, status string) {
+	if status == "" || status == searchStatusRunning {
+		return
+	}
+
+	if err := x.store.release(userID, searchID); err != nil {
+		logger.WithError(err).WithField("user", userID).Error("Fail to update running searches")
+	}
+}
+
+func abortTooManyRequests(c *gin.Context, wait time.Duration, msg string) {
+	sec := int(math.Ceil(wait.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+
+	logger.WithFields(logrus.Fields{
+		"user":        c.MustGet("session").(*strixUser).UserID,
+		"retry_after": sec,
+	}).Warn(msg)
+
+	c.Header("Retry-After", strconv.Itoa(sec))
+	c.JSON(http.StatusTooManyRequests, gin.H{"msg": msg, "retry_after": sec})
+}
@@ -0,0 +1,60 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	store := main.NewMemoryRateLimitStore()
+	limit := main.RateLimit{PerMinute: 60, Burst: 3}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, main.RateLimitTake(store, "blue", limit, now))
+	}
+	assert.Equal(t, time.Second, main.RateLimitTake(store, "blue", limit, now))
+	// Other user has own bucket
+	assert.Zero(t, main.RateLimitTake(store, "orange", limit, now))
+	// A token is added per second
+	assert.Zero(t, main.RateLimitTake(store, "blue", limit, now.Add(time.Second)))
+	assert.NotZero(t, main.RateLimitTake(store, "blue", limit, now.Add(time.Second)))
+}
+
+func TestRateLimitConcurrentSearches(t *testing.T) {
+	store := main.NewMemoryRateLimitStore()
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.True(t, main.RateLimitAcquire(store, "blue", "s1", 2, now))
+	assert.True(t, main.RateLimitAcquire(store, "blue", "s2", 2, now))
+	assert.False(t, main.RateLimitAcquire(store, "blue", "s3", 2, now))
+
+	main.RateLimitRelease(store, "blue", "s1")
+	assert.True(t, main.RateLimitAcquire(store, "blue", "s3", 2, now))
+	assert.False(t, main.RateLimitAcquire(store, "blue", "s4", 2, now))
+
+	// Slots of searches never completed are expired
+	assert.True(t, main.RateLimitAcquire(store, "blue", "s4", 2, now.Add(time.Hour)))
+}
+
+func TestRateLimitOfRole(t *testing.T) {
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [
+			{"name": "analyst", "permitted_tags": ["web"]},
+			{"name": "bot", "permitted_tags": ["web"], "rate_limit": {"per_minute": 600, "max_concurrent_searches": 10}}
+		],
+		"users": [
+			{"user_id": "blue@example.com", "role": "analyst"},
+			{"user_id": "robot@example.com", "role": "bot"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	defaults := main.RateLimit{PerMinute: 60, Burst: 10, MaxConcurrent: 2}
+	assert.Equal(t, defaults, main.RateLimitOf(srv, "blue@example.com", defaults))
+	assert.Equal(t, main.RateLimit{PerMinute: 600, MaxConcurrent: 10}, main.RateLimitOf(srv, "robot@example.com", defaults))
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	scimSchemaUser  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaList  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaSPC   = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	scimContentType = "application/scim+json"
+	scimMaxResults  = 200
+)
+
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func newScimError(status int, scimType, detail string) *scimError {
+	return &scimError{status: status, scimType: scimType, detail: detail}
+}
+
+func (x *scimError) Error() string {
+	return x.detail
+}
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimUserResource struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Emails      []scimValue `json:"emails,omitempty"`
+	Roles       []scimValue `json:"roles,omitempty"`
+	Groups      []scimValue `json:"groups,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimHandler struct {
+	store *scimStore
+	base  string
+}
+
+func scimJSON(c *gin.Context, status int, obj interface{}) {
+	c.Header("Content-Type", scimContentType)
+	c.JSON(status, obj)
+}
+
+func scimAbort(c *gin.Context, err error) {
+	scimErr, ok := err.(*scimError)
+	if !ok {
+		logger.WithError(err).Error("SCIM request failed")
+		scimErr = newScimError(http.StatusInternalServerError, "", "Internal server error")
+	}
+
+	resp := gin.H{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(scimErr.status),
+		"detail":  scimErr.detail,
+	}
+	if scimErr.scimType != "" {
+		resp["scimType"] = scimErr.scimType
+	}
+
+	c.Header("Content-Type", scimContentType)
+	c.AbortWithStatusJSON(scimErr.status, resp)
+}
+
+func (x *scimHandler) location(c *gin.Context, resource, id string) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/%s/%s", scheme, c.Request.Host, x.base, resource, id)
+}
+
+func (x *scimHandler) userResource(c *gin.Context, user *scimUser, groups []*scimGroup) *scimUserResource {
+	active := user.Active
+	res := &scimUserResource{
+		Schemas:     []string{scimSchemaUser},
+		ID:          user.ID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.UserName,
+		DisplayName: user.DisplayName,
+		Active:      &active,
+		Emails:      user.Emails,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      user.Created,
+			LastModified: user.LastModified,
+			Location:     x.location(c, "Users", user.ID),
+		},
+	}
+
+	for _, role := range user.Roles {
+		res.Roles = append(res.Roles, scimValue{Value: role})
+	}
+	for _, g := range groups {
+		res.Groups = append(res.Groups, scimValue{Value: g.ID, Display: g.DisplayName})
+	}
+
+	return res
+}
+
+func (x *scimHandler) groupResource(c *gin.Context, group *scimGroup) *scimGroupResource {
+	res := &scimGroupResource{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created:      group.Created,
+			LastModified: group.LastModified,
+			Location:     x.location(c, "Groups", group.ID),
+		},
+	}
+
+	for _, m := range group.Members {
+		res.Members = append(res.Members, scimValue{Value: m, Display: x.store.userDisplay(m)})
+	}
+
+	return res
+}
+
+var scimFilterPattern = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+"([^"]*)"\s*$`)
+
+// parseScimFilter supports only `attribute eq "value"` that is used by
+// identity providers to find existing resources.
+func parseScimFilter(filter string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", newScimError(http.StatusBadRequest, "invalidFilter", "Unsupported filter: "+filter)
+	}
+
+	return m[1], m[2], nil
+}
+
+// paginate slices resources by startIndex (1-origin) and count parameters.
+func paginate(c *gin.Context, total int) (int, int, error) {
+	start, count := 1, scimMaxResults
+
+	if v := c.Query("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, newScimError(http.StatusBadRequest, "invalidValue", "Invalid startIndex: "+v)
+		}
+		if n > 1 {
+			start = n
+		}
+	}
+	if v := c.Query("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, newScimError(http.StatusBadRequest, "invalidValue", "Invalid count: "+v)
+		}
+		if n >= 0 && n < count {
+			count = n
+		}
+	}
+
+	from := start - 1
+	if from > total {
+		from = total
+	}
+	to := from + count
+	if to > total {
+		to = total
+	}
+
+	return from, to, nil
+}
+
+func bindScim(c *gin.Context, obj interface{}) error {
+	raw, err := c.GetRawData()
+	if err != nil {
+		return newScimError(http.StatusBadRequest, "invalidSyntax", "Fail to read request body")
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return newScimError(http.StatusBadRequest, "invalidSyntax", "Invalid JSON: "+err.Error())
+	}
+	return nil
+}
+
+// parseScimBool accepts both of JSON boolean and string such as "False" that
+// is sent by some identity providers.
+func parseScimBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if v, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+			return v, nil
+		}
+	}
+
+	return false, newScimError(http.StatusBadRequest, "invalidValue", "Invalid boolean value: "+string(raw))
+}
+
+func parseScimString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", newScimError(http.StatusBadRequest, "invalidValue", "Invalid string value: "+string(raw))
+	}
+	return s, nil
+}
+
+// parseScimValues accepts an array of values or a single value.
+func parseScimValues(raw json.RawMessage) ([]scimValue, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var values []scimValue
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return values, nil
+	}
+
+	var value scimValue
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return []scimValue{value}, nil
+	}
+
+	return nil, newScimError(http.StatusBadRequest, "invalidValue", "Invalid multi-valued attribute: "+string(raw))
+}
+
+func scimValueList(values []scimValue) []string {
+	var result []string
+	for _, v := range values {
+		result = append(result, v.Value)
+	}
+	return result
+}
+
+var scimValuePathPattern = regexp.MustCompile(`^([A-Za-z]+)\[\s*value\s+(?i:eq)\s+"([^"]*)"\s*\]$`)
+
+// applyMultiValued applies add, remove and replace operation to a list of
+// values such as roles and members.
+func applyMultiValued(current []string, op, path string, raw json.RawMessage) ([]string, error) {
+	if m := scimValuePathPattern.FindStringSubmatch(path); m != nil {
+		if op != "remove" {
+			return nil, newScimError(http.StatusBadRequest, "invalidPath", "Unsupported operation for path: "+path)
+		}
+		return removeString(current, m[2]), nil
+	}
+
+	values, err := parseScimValues(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "add":
+		return uniqueStrings(append(current, scimValueList(values)...)), nil
+	case "replace":
+		return uniqueStrings(scimValueList(values)), nil
+	case "remove":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		for _, v := range values {
+			current = removeString(current, v.Value)
+		}
+		return current, nil
+	}
+
+	return nil, newScimError(http.StatusBadRequest, "invalidSyntax", "Invalid operation: "+op)
+}
+
+func patchUserAttr(user *scimUser, op, path string, raw json.RawMessage) error {
+	attr := strings.ToLower(path)
+	if i := strings.Index(attr, "["); i > 0 {
+		attr = attr[:i]
+	}
+
+	var err error
+	switch attr {
+	case "active":
+		if op == "remove" {
+			return newScimError(http.StatusBadRequest, "mutability", "active can not be removed")
+		}
+		user.Active, err = parseScimBool(raw)
+	case "username":
+		if op == "remove" {
+			return newScimError(http.StatusBadRequest, "mutability", "userName can not be removed")
+		}
+		user.UserName, err = parseScimString(raw)
+	case "displayname":
+		user.DisplayName = ""
+		if op != "remove" {
+			user.DisplayName, err = parseScimString(raw)
+		}
+	case "externalid":
+		user.ExternalID = ""
+		if op != "remove" {
+			user.ExternalID, err = parseScimString(raw)
+		}
+	case "emails":
+		user.Emails = nil
+		if op != "remove" {
+			user.Emails, err = parseScimValues(raw)
+		}
+	case "roles":
+		user.Roles, err = applyMultiValued(user.Roles, op, path, raw)
+	default:
+		return newScimError(http.StatusBadRequest, "invalidPath", "Unsupported path: "+path)
+	}
+
+	return err
+}
+
+func patchGroupAttr(group *scimGroup, op, path string, raw json.RawMessage) error {
+	attr := strings.ToLower(path)
+	if i := strings.Index(attr, "["); i > 0 {
+		attr = attr[:i]
+	}
+
+	var err error
+	switch attr {
+	case "displayname":
+		if op == "remove" {
+			return newScimError(http.StatusBadRequest, "mutability", "displayName can not be removed")
+		}
+		group.DisplayName, err = parseScimString(raw)
+	case "externalid":
+		group.ExternalID = ""
+		if op != "remove" {
+			group.ExternalID, err = parseScimString(raw)
+		}
+	case "members":
+		group.Members, err = applyMultiValued(group.Members, op, path, raw)
+	default:
+		return newScimError(http.StatusBadRequest, "invalidPath", "Unsupported path: "+path)
+	}
+
+	return err
+}
+
+// applyPatch runs patch operations. An operation without path has an object
+// as value and each attribute of the object is applied.
+func applyPatch(ops []scimPatchOp, apply func(op, path string, raw json.RawMessage) error) error {
+	for _, op := range ops {
+		name := strings.ToLower(op.Op)
+		if name != "add" && name != "remove" && name != "replace" {
+			return newScimError(http.StatusBadRequest, "invalidSyntax", "Invalid operation: "+op.Op)
+		}
+
+		if op.Path != "" {
+			if err := apply(name, op.Path, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return newScimError(http.StatusBadRequest, "noTarget", "Operation without path requires an object value")
+		}
+		for path, raw := range attrs {
+			if err := apply(name, path, raw); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (x *scimHandler) parseUser(c *gin.Context) (*scimUser, error) {
+	var res scimUserResource
+	if err := bindScim(c, &res); err != nil {
+		return nil, err
+	}
+	if res.UserName == "" {
+		return nil, newScimError(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+
+	user := &scimUser{
+		ExternalID:  res.ExternalID,
+		UserName:    res.UserName,
+		DisplayName: res.DisplayName,
+		Active:      true,
+		Emails:      res.Emails,
+		Roles:       uniqueStrings(scimValueList(res.Roles)),
+	}
+	if res.Active != nil {
+		user.Active = *res.Active
+	}
+
+	return user, nil
+}
+
+func (x *scimHandler) parseGroup(c *gin.Context) (*scimGroup, error) {
+	var res scimGroupResource
+	if err := bindScim(c, &res); err != nil {
+		return nil, err
+	}
+	if res.DisplayName == "" {
+		return nil, newScimError(http.StatusBadRequest, "invalidValue", "displayName is required")
+	}
+
+	return &scimGroup{
+		ExternalID:  res.ExternalID,
+		DisplayName: res.DisplayName,
+		Members:     uniqueStrings(scimValueList(res.Members)),
+	}, nil
+}
+
+func (x *scimHandler) listUsers(c *gin.Context) {
+	attr, value, err := parseScimFilter(c.Query("filter"))
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	users := x.store.listUsers(func(u *scimUser) bool {
+		switch strings.ToLower(attr) {
+		case "":
+			return true
+		case "username":
+			return normalizeUserName(u.UserName) == normalizeUserName(value)
+		case "externalid":
+			return u.ExternalID == value
+		case "id":
+			return u.ID == value
+		case "displayname":
+			return u.DisplayName == value
+		}
+		return false
+	})
+
+	from, to, err := paginate(c, len(users))
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	resp := scimListResponse{
+		Schemas:      []string{scimSchemaList},
+		TotalResults: len(users),
+		StartIndex:   from + 1,
+		ItemsPerPage: to - from,
+		Resources:    []interface{}{},
+	}
+	for _, u := range users[from:to] {
+		_, groups := x.store.getUser(u.ID)
+		resp.Resources = append(resp.Resources, x.userResource(c, u, groups))
+	}
+
+	scimJSON(c, http.StatusOK, resp)
+}
+
+func (x *scimHandler) getUser(c *gin.Context) {
+	user, groups := x.store.getUser(c.Param("id"))
+	if user == nil {
+		scimAbort(c, newScimError(http.StatusNotFound, "", "User not found: "+c.Param("id")))
+		return
+	}
+
+	scimJSON(c, http.StatusOK, x.userResource(c, user, groups))
+}
+
+func (x *scimHandler) createUser(c *gin.Context) {
+	user, err := x.parseUser(c)
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	if err := x.store.createUser(user); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"user":   user.UserName,
+		"active": user.Active,
+		"roles":  user.Roles,
+	}).Info("SCIM user provisioned")
+
+	c.Header("Location", x.location(c, "Users", user.ID))
+	scimJSON(c, http.StatusCreated, x.userResource(c, user, nil))
+}
+
+func (x *scimHandler) replaceUser(c *gin.Context) {
+	replaced, err := x.parseUser(c)
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	user, err := x.store.updateUser(c.Param("id"), func(u *scimUser) error {
+		*u = *replaced
+		return nil
+	})
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	x.respondUser(c, user)
+}
+
+func (x *scimHandler) patchUser(c *gin.Context) {
+	var req scimPatchRequest
+	if err := bindScim(c, &req); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	user, err := x.store.updateUser(c.Param("id"), func(u *scimUser) error {
+		return applyPatch(req.Operations, func(op, path string, raw json.RawMessage) error {
+			return patchUserAttr(u, op, path, raw)
+		})
+	})
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	x.respondUser(c, user)
+}
+
+func (x *scimHandler) respondUser(c *gin.Context, user *scimUser) {
+	logger.WithFields(logrus.Fields{
+		"user":   user.UserName,
+		"active": user.Active,
+		"roles":  user.Roles,
+	}).Info("SCIM user updated")
+
+	_, groups := x.store.getUser(user.ID)
+	scimJSON(c, http.StatusOK, x.userResource(c, user, groups))
+}
+
+func (x *scimHandler) deleteUser(c *gin.Context) {
+	if err := x.store.deleteUser(c.Param("id")); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	logger.WithField("id", c.Param("id")).Info("SCIM user deprovisioned")
+	c.Status(http.StatusNoContent)
+}
+
+func (x *scimHandler) listGroups(c *gin.Context) {
+	attr, value, err := parseScimFilter(c.Query("filter"))
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	groups := x.store.listGroups(func(g *scimGroup) bool {
+		switch strings.ToLower(attr) {
+		case "":
+			return true
+		case "displayname":
+			return g.DisplayName == value
+		case "externalid":
+			return g.ExternalID == value
+		case "id":
+			return g.ID == value
+		}
+		return false
+	})
+
+	from, to, err := paginate(c, len(groups))
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	resp := scimListResponse{
+		Schemas:      []string{scimSchemaList},
+		TotalResults: len(groups),
+		StartIndex:   from + 1,
+		ItemsPerPage: to - from,
+		Resources:    []interface{}{},
+	}
+	for _, g := range groups[from:to] {
+		resp.Resources = append(resp.Resources, x.groupResource(c, g))
+	}
+
+	scimJSON(c, http.StatusOK, resp)
+}
+
+func (x *scimHandler) getGroup(c *gin.Context) {
+	group := x.store.getGroup(c.Param("id"))
+	if group == nil {
+		scimAbort(c, newScimError(http.StatusNotFound, "", "Group not found: "+c.Param("id")))
+		return
+	}
+
+	scimJSON(c, http.StatusOK, x.groupResource(c, group))
+}
+
+func (x *scimHandler) createGroup(c *gin.Context) {
+	group, err := x.parseGroup(c)
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	if err := x.store.createGroup(group); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"group":   group.DisplayName,
+		"members": len(group.Members),
+	}).Info("SCIM group provisioned")
+
+	c.Header("Location", x.location(c, "Groups", group.ID))
+	scimJSON(c, http.StatusCreated, x.groupResource(c, group))
+}
+
+func (x *scimHandler) replaceGroup(c *gin.Context) {
+	replaced, err := x.parseGroup(c)
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	group, err := x.store.updateGroup(c.Param("id"), func(g *scimGroup) error {
+		*g = *replaced
+		return nil
+	})
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	x.respondGroup(c, group)
+}
+
+func (x *scimHandler) patchGroup(c *gin.Context) {
+	var req scimPatchRequest
+	if err := bindScim(c, &req); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	group, err := x.store.updateGroup(c.Param("id"), func(g *scimGroup) error {
+		return applyPatch(req.Operations, func(op, path string, raw json.RawMessage) error {
+			return patchGroupAttr(g, op, path, raw)
+		})
+	})
+	if err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	x.respondGroup(c, group)
+}
+
+func (x *scimHandler) respondGroup(c *gin.Context, group *scimGroup) {
+	logger.WithFields(logrus.Fields{
+		"group":   group.DisplayName,
+		"members": len(group.Members),
+	}).Info("SCIM group updated")
+
+	scimJSON(c, http.StatusOK, x.groupResource(c, group))
+}
+
+func (x *scimHandler) deleteGroup(c *gin.Context) {
+	if err := x.store.deleteGroup(c.Param("id")); err != nil {
+		scimAbort(c, err)
+		return
+	}
+
+	logger.WithField("id", c.Param("id")).Info("SCIM group deleted")
+	c.Status(http.StatusNoContent)
+}
+
+func serviceProviderConfig(c *gin.Context) {
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":        []string{scimSchemaSPC},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication with a static bearer token",
+		}},
+	})
+}
+
+func scimBearerAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(c *gin.Context) {
+		actual := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			logger.WithField("ipaddr", c.ClientIP()).Warn("SCIM authentication fail")
+			scimAbort(c, newScimError(http.StatusUnauthorized, "", "Authentication failed"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// setupSCIM provides SCIM 2.0 Users and Groups endpoints to provision users
+// and role assignments. Roles are given as "roles" of User and groups can be
+// matched by "group" of authz rules.
+func setupSCIM(store *scimStore, token string, r *gin.RouterGroup) error {
+	if token == "" {
+		return fmt.Errorf("SCIM bearer token is required")
+	}
+
+	h := &scimHandler{store: store, base: r.BasePath()}
+	r.Use(scimBearerAuth(token))
+
+	r.GET("/ServiceProviderConfig", serviceProviderConfig)
+
+	r.GET("/Users", h.listUsers)
+	r.POST("/Users", h.createUser)
+	r.GET("/Users/:id", h.getUser)
+	r.PUT("/Users/:id", h.replaceUser)
+	r.PATCH("/Users/:id", h.patchUser)
+	r.DELETE("/Users/:id", h.deleteUser)
+
+	r.GET("/Groups", h.listGroups)
+	r.POST("/Groups", h.createGroup)
+	r.GET("/Groups/:id", h.getGroup)
+	r.PUT("/Groups/:id", h.replaceGroup)
+	r.PATCH("/Groups/:id", h.patchGroup)
+	r.DELETE("/Groups/:id", h.deleteGroup)
+
+	return nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type scimUser struct {
+	ID           string      `json:"id"`
+	ExternalID   string      `json:"external_id,omitempty"`
+	UserName     string      `json:"user_name"`
+	DisplayName  string      `json:"display_name,omitempty"`
+	Active       bool        `json:"active"`
+	Emails       []scimValue `json:"emails,omitempty"`
+	Roles        []string    `json:"roles,omitempty"`
+	Created      time.Time   `json:"created"`
+	LastModified time.Time   `json:"last_modified"`
+}
+
+type scimGroup struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	DisplayName  string    `json:"display_name"`
+	Members      []string  `json:"members,omitempty"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// scimStore keeps users and groups provisioned via SCIM and saves them to a
+// JSON file on every change. It works as authzDirectory.
+type scimStore struct {
+	path  string
+	mutex sync.RWMutex
+	data  scimStoreData
+}
+
+type scimStoreData struct {
+	Users  map[string]*scimUser  `json:"users"`
+	Groups map[string]*scimGroup `json:"groups"`
+
+	// Deprovisioned keeps user names deleted via SCIM to keep rejecting them
+	// even if the static authz table has a matching rule.
+	Deprovisioned map[string]time.Time `json:"deprovisioned"`
+}
+
+func newScimStore(path string) (*scimStore, error) {
+	store := &scimStore{
+		path: path,
+		data: scimStoreData{
+			Users:         map[string]*scimUser{},
+			Groups:        map[string]*scimGroup{},
+			Deprovisioned: map[string]time.Time{},
+		},
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read SCIM store: %s", path)
+	}
+
+	if err := json.Unmarshal(raw, &store.data); err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse SCIM store: %s", path)
+	}
+	if store.data.Users == nil {
+		store.data.Users = map[string]*scimUser{}
+	}
+	if store.data.Groups == nil {
+		store.data.Groups = map[string]*scimGroup{}
+	}
+	if store.data.Deprovisioned == nil {
+		store.data.Deprovisioned = map[string]time.Time{}
+	}
+
+	return store, nil
+}
+
+// clone returns a copy of maps to stage a change. Entries are shared, then a
+// changed entry must be replaced by its copy instead of being modified.
+func (x scimStoreData) clone() scimStoreData {
+	c := scimStoreData{
+		Users:         make(map[string]*scimUser, len(x.Users)),
+		Groups:        make(map[string]*scimGroup, len(x.Groups)),
+		Deprovisioned: make(map[string]time.Time, len(x.Deprovisioned)),
+	}
+	for k, v := range x.Users {
+		c.Users[k] = v
+	}
+	for k, v := range x.Groups {
+		c.Groups[k] = v
+	}
+	for k, v := range x.Deprovisioned {
+		c.Deprovisioned[k] = v
+	}
+	return c
+}
+
+// commit saves staged data and replaces the current data with it. The
+// current data is kept if saving fails. Caller must hold the write lock.
+func (x *scimStore) commit(data scimStoreData) error {
+	if err := x.save(data); err != nil {
+		return err
+	}
+	x.data = data
+	return nil
+}
+
+// save writes data to a temporary file and renames it to prevent a broken
+// store file.
+func (x *scimStore) save(data scimStoreData) error {
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal SCIM store")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(x.path), ".scim-*.json")
+	if err != nil {
+		return errors.Wrapf(err, "Fail to create temp file for SCIM store: %s", x.path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Fail to write SCIM store: %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Fail to close SCIM store: %s", tmp.Name())
+	}
+
+	if err := os.Rename(tmp.Name(), x.path); err != nil {
+		return errors.Wrapf(err, "Fail to save SCIM store: %s", x.path)
+	}
+
+	return nil
+}
+
+func normalizeUserName(userName string) string {
+	return strings.ToLower(userName)
+}
+
+// find implements authzDirectory. Groups are given as display names of SCIM
+// groups so that they can be matched by "group" of authz rules.
+func (x *scimStore) find(userID string) (*directoryEntry, bool) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	name := normalizeUserName(userID)
+	if _, ok := x.data.Deprovisioned[name]; ok {
+		return &directoryEntry{Active: false}, true
+	}
+
+	user := x.userByName(name)
+	if user == nil {
+		return nil, false
+	}
+
+	return &directoryEntry{
+		Active: user.Active,
+		Roles:  user.Roles,
+		Groups: x.groupNamesOf(user.ID),
+	}, true
+}
+
+func (x *scimStore) userByName(name string) *scimUser {
+	for _, u := range x.data.Users {
+		if normalizeUserName(u.UserName) == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (x *scimStore) groupNamesOf(userID string) []string {
+	var names []string
+	for _, g := range x.groupsOf(userID) {
+		names = append(names, g.DisplayName)
+	}
+	return names
+}
+
+func (x *scimStore) groupsOf(userID string) []*scimGroup {
+	var groups []*scimGroup
+	for _, g := range x.data.Groups {
+		for _, m := range g.Members {
+			if m == userID {
+				groups = append(groups, g)
+				break
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	return groups
+}
+
+func copyScimUser(u *scimUser) *scimUser {
+	c := *u
+	c.Emails = append([]scimValue{}, u.Emails...)
+	c.Roles = append([]string{}, u.Roles...)
+	return &c
+}
+
+func copyScimGroup(g *scimGroup) *scimGroup {
+	c := *g
+	c.Members = append([]string{}, g.Members...)
+	return &c
+}
+
+func (x *scimStore) listUsers(match func(u *scimUser) bool) []*scimUser {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var users []*scimUser
+	for _, u := range x.data.Users {
+		if match(u) {
+			users = append(users, copyScimUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Created.Before(users[j].Created) })
+	return users
+}
+
+func (x *scimStore) getUser(id string) (*scimUser, []*scimGroup) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	u, ok := x.data.Users[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyScimUser(u), x.groupsOf(id)
+}
+
+func (x *scimStore) createUser(user *scimUser) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	name := normalizeUserName(user.UserName)
+	if x.userByName(name) != nil {
+		return newScimError(409, "uniqueness", "userName already exists: "+user.UserName)
+	}
+
+	now := time.Now().UTC()
+	user.ID = uuid.New().String()
+	user.Created, user.LastModified = now, now
+
+	data := x.data.clone()
+	data.Users[user.ID] = copyScimUser(user)
+	delete(data.Deprovisioned, name)
+
+	return x.commit(data)
+}
+
+// updateUser applies update to a copy of the user and stores it if update
+// succeeds. The old userName is deprovisioned if it's renamed.
+func (x *scimStore) updateUser(id string, update func(u *scimUser) error) (*scimUser, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	current, ok := x.data.Users[id]
+	if !ok {
+		return nil, newScimError(404, "", "User not found: "+id)
+	}
+
+	user := copyScimUser(current)
+	if err := update(user); err != nil {
+		return nil, err
+	}
+	user.ID, user.Created = current.ID, current.Created
+	user.LastModified = time.Now().UTC()
+
+	name := normalizeUserName(user.UserName)
+	if other := x.userByName(name); other != nil && other.ID != id {
+		return nil, newScimError(409, "uniqueness", "userName already exists: "+user.UserName)
+	}
+
+	data := x.data.clone()
+	data.Users[id] = user
+	if oldName := normalizeUserName(current.UserName); oldName != name {
+		data.Deprovisioned[oldName] = user.LastModified
+		delete(data.Deprovisioned, name)
+	}
+
+	if err := x.commit(data); err != nil {
+		return nil, err
+	}
+	return copyScimUser(user), nil
+}
+
+func (x *scimStore) deleteUser(id string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	user, ok := x.data.Users[id]
+	if !ok {
+		return newScimError(404, "", "User not found: "+id)
+	}
+
+	data := x.data.clone()
+	delete(data.Users, id)
+	for _, g := range x.groupsOf(id) {
+		group := copyScimGroup(g)
+		group.Members = removeString(group.Members, id)
+		data.Groups[g.ID] = group
+	}
+	data.Deprovisioned[normalizeUserName(user.UserName)] = time.Now().UTC()
+
+	return x.commit(data)
+}
+
+func (x *scimStore) listGroups(match func(g *scimGroup) bool) []*scimGroup {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var groups []*scimGroup
+	for _, g := range x.data.Groups {
+		if match(g) {
+			groups = append(groups, copyScimGroup(g))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Created.Before(groups[j].Created) })
+	return groups
+}
+
+func (x *scimStore) getGroup(id string) *scimGroup {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	g, ok := x.data.Groups[id]
+	if !ok {
+		return nil
+	}
+	return copyScimGroup(g)
+}
+
+func (x *scimStore) userDisplay(id string) string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	if u, ok := x.data.Users[id]; ok {
+		return u.UserName
+	}
+	return ""
+}
+
+// validMembers checks that all members are existing users. Caller must hold
+// the lock.
+func (x *scimStore) validMembers(members []string) error {
+	for _, m := range members {
+		if _, ok := x.data.Users[m]; !ok {
+			return newScimError(400, "invalidValue", "Member is not found: "+m)
+		}
+	}
+	return nil
+}
+
+func (x *scimStore) createGroup(group *scimGroup) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, g := range x.data.Groups {
+		if g.DisplayName == group.DisplayName {
+			return newScimError(409, "uniqueness", "displayName already exists: "+group.DisplayName)
+		}
+	}
+	if err := x.validMembers(group.Members); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	group.ID = uuid.New().String()
+	group.Created, group.LastModified = now, now
+
+	data := x.data.clone()
+	data.Groups[group.ID] = copyScimGroup(group)
+
+	return x.commit(data)
+}
+
+func (x *scimStore) updateGroup(id string, update func(g *scimGroup) error) (*scimGroup, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	current, ok := x.data.Groups[id]
+	if !ok {
+		return nil, newScimError(404, "", "Group not found: "+id)
+	}
+
+	group := copyScimGroup(current)
+	if err := update(group); err != nil {
+		return nil, err
+	}
+	group.ID, group.Created = current.ID, current.Created
+	group.LastModified = time.Now().UTC()
+	group.Members = uniqueStrings(group.Members)
+
+	for _, g := range x.data.Groups {
+		if g.ID != id && g.DisplayName == group.DisplayName {
+			return nil, newScimError(409, "uniqueness", "displayName already exists: "+group.DisplayName)
+		}
+	}
+	if err := x.validMembers(group.Members); err != nil {
+		return nil, err
+	}
+
+	data := x.data.clone()
+	data.Groups[id] = group
+
+	if err := x.commit(data); err != nil {
+		return nil, err
+	}
+	return copyScimGroup(group), nil
+}
+
+func (x *scimStore) deleteGroup(id string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if _, ok := x.data.Groups[id]; !ok {
+		return newScimError(404, "", "Group not found: "+id)
+	}
+	data := x.data.clone()
+	delete(data.Groups, id)
+
+	return x.commit(data)
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func uniqueStrings(list []string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, v := range list {
+		if !seen[v] {
+			result = append(result, v)
+			seen[v] = true
+		}
+	}
+	return result
+}
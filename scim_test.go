@@ -0,0 +1,221 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scimTestToken = "test-token"
+
+func scimRequest(t *testing.T, r http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+scimTestToken)
+	req.Header.Set("Content-Type", "application/scim+json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp map[string]interface{}
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w.Code, resp
+}
+
+func TestSCIMProvisioning(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	storePath := filepath.Join(t.TempDir(), "scim.json")
+
+	authz, err := main.NewAuthzService([]byte(`{
+		"roles": [
+			{"name":"blue", "permitted_tags":["spell.1"]},
+			{"name":"orange", "permitted_tags":["spell.2"]}
+		],
+		"rules": [
+			{"user_regex":"@example.com$", "role":"blue"},
+			{"group":"responders", "role":"orange"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	store, err := main.NewScimStore(storePath)
+	require.NoError(t, err)
+	holder := main.NewAuthzHolderWithDirectory(authz, store)
+
+	r := gin.New()
+	require.NoError(t, main.SetupSCIM(store, scimTestToken, r.Group("/scim/v2")))
+
+	// Bearer token is required
+	req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Joiner gets roles
+	code, user := scimRequest(t, r, "POST", "/scim/v2/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "alpha@example.org",
+		"roles": [{"value": "blue"}, {"value": "orange"}]
+	}`)
+	require.Equal(t, http.StatusCreated, code)
+	userID := user["id"].(string)
+
+	alpha := main.AuthzHolderResolve(holder, "alpha@example.org", nil)
+	require.NotNil(t, alpha)
+	assert.ElementsMatch(t, []string{"spell.1", "spell.2"}, main.AuthzUserAllowed(alpha))
+
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "ALPHA@example.org"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, list := scimRequest(t, r, "GET", `/scim/v2/Users?filter=userName+eq+"alpha@example.org"`, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), list["totalResults"])
+
+	// Group membership is matched by group rules
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "bravo@example.org"}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Nil(t, main.AuthzHolderResolve(holder, "bravo@example.org", nil))
+
+	_, bravoList := scimRequest(t, r, "GET", `/scim/v2/Users?filter=userName+eq+"bravo@example.org"`, "")
+	bravoID := bravoList["Resources"].([]interface{})[0].(map[string]interface{})["id"].(string)
+
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Groups", `{
+		"displayName": "responders",
+		"members": [{"value": "`+bravoID+`"}]
+	}`)
+	require.Equal(t, http.StatusCreated, code)
+	bravo := main.AuthzHolderResolve(holder, "bravo@example.org", nil)
+	require.NotNil(t, bravo)
+	assert.Contains(t, main.AuthzUserAllowed(bravo), "spell.2")
+
+	// Store is persistent
+	reloaded, err := main.NewScimStore(storePath)
+	require.NoError(t, err)
+	assert.NotNil(t, main.AuthzHolderResolve(main.NewAuthzHolderWithDirectory(authz, reloaded), "bravo@example.org", nil))
+
+	// Leaver loses access
+	code, _ = scimRequest(t, r, "PATCH", "/scim/v2/Users/"+userID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "active", "value": "False"}]
+	}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, main.AuthzHolderResolve(holder, "alpha@example.org", nil))
+
+	// Deleted user is rejected even if static rule matches
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "charlie@example.com"}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.NotNil(t, main.AuthzHolderResolve(holder, "charlie@example.com", nil))
+
+	_, charlieList := scimRequest(t, r, "GET", `/scim/v2/Users?filter=userName+eq+"charlie@example.com"`, "")
+	charlieID := charlieList["Resources"].([]interface{})[0].(map[string]interface{})["id"].(string)
+	code, _ = scimRequest(t, r, "DELETE", "/scim/v2/Users/"+charlieID, "")
+	require.Equal(t, http.StatusNoContent, code)
+	assert.Nil(t, main.AuthzHolderResolve(holder, "charlie@example.com", nil))
+	assert.NotNil(t, main.AuthzHolderResolve(holder, "delta@example.com", nil))
+}
+
+func TestSCIMRename(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	authz, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name":"blue", "permitted_tags":["spell.1"]}],
+		"rules": [{"user_regex":"@example.com$", "role":"blue"}]
+	}`))
+	require.NoError(t, err)
+
+	store, err := main.NewScimStore(filepath.Join(t.TempDir(), "scim.json"))
+	require.NoError(t, err)
+	holder := main.NewAuthzHolderWithDirectory(authz, store)
+
+	r := gin.New()
+	require.NoError(t, main.SetupSCIM(store, scimTestToken, r.Group("/scim/v2")))
+
+	code, user := scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "alpha@example.com"}`)
+	require.Equal(t, http.StatusCreated, code)
+	userID := user["id"].(string)
+
+	code, _ = scimRequest(t, r, "PATCH", "/scim/v2/Users/"+userID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "userName", "value": "bravo@example.com"}]
+	}`)
+	require.Equal(t, http.StatusOK, code)
+
+	// Old name is rejected even if static rule matches
+	assert.Nil(t, main.AuthzHolderResolve(holder, "alpha@example.com", nil))
+	assert.NotNil(t, main.AuthzHolderResolve(holder, "bravo@example.com", nil))
+
+	// Renamed back to the old name
+	code, _ = scimRequest(t, r, "PATCH", "/scim/v2/Users/"+userID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "userName", "value": "alpha@example.com"}]
+	}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, main.AuthzHolderResolve(holder, "alpha@example.com", nil))
+	assert.Nil(t, main.AuthzHolderResolve(holder, "bravo@example.com", nil))
+}
+
+func TestSCIMSaveFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	storeDir := filepath.Join(t.TempDir(), "scim")
+	require.NoError(t, os.Mkdir(storeDir, 0700))
+
+	authz, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name":"orange", "permitted_tags":["spell.2"]}],
+		"rules": [{"group":"responders", "role":"orange"}]
+	}`))
+	require.NoError(t, err)
+
+	store, err := main.NewScimStore(filepath.Join(storeDir, "scim.json"))
+	require.NoError(t, err)
+	holder := main.NewAuthzHolderWithDirectory(authz, store)
+
+	r := gin.New()
+	require.NoError(t, main.SetupSCIM(store, scimTestToken, r.Group("/scim/v2")))
+
+	code, user := scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "alpha@example.org"}`)
+	require.Equal(t, http.StatusCreated, code)
+	userID := user["id"].(string)
+	code, group := scimRequest(t, r, "POST", "/scim/v2/Groups", `{
+		"displayName": "responders",
+		"members": [{"value": "`+userID+`"}]
+	}`)
+	require.Equal(t, http.StatusCreated, code)
+	groupID := group["id"].(string)
+
+	// Store file can not be written
+	require.NoError(t, os.RemoveAll(storeDir))
+
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Users", `{"userName": "bravo@example.org"}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, _ = scimRequest(t, r, "PATCH", "/scim/v2/Users/"+userID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "userName", "value": "charlie@example.org"}]
+	}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, _ = scimRequest(t, r, "DELETE", "/scim/v2/Users/"+userID, "")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, _ = scimRequest(t, r, "POST", "/scim/v2/Groups", `{"displayName": "auditors"}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, _ = scimRequest(t, r, "DELETE", "/scim/v2/Groups/"+groupID, "")
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	// Nothing is changed
+	_, users := scimRequest(t, r, "GET", "/scim/v2/Users", "")
+	assert.Equal(t, float64(1), users["totalResults"])
+	_, groups := scimRequest(t, r, "GET", "/scim/v2/Groups", "")
+	assert.Equal(t, float64(1), groups["totalResults"])
+
+	alpha := main.AuthzHolderResolve(holder, "alpha@example.org", nil)
+	require.NotNil(t, alpha)
+	assert.Contains(t, main.AuthzUserAllowed(alpha), "spell.2")
+	assert.Nil(t, main.AuthzHolderResolve(holder, "charlie@example.org", nil))
+}
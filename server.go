@@ -1,31 +1,265 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
-	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type arguments struct {
+	// Config file of options, see options
+	ConfigPath string
+
 	LogLevel       string
 	Endpoint       string
 	BindAddress    string
 	BindPort       int
 	StaticContents string
+	BasePath       string
 	HelloReply     string
 	APIKey         string
 	AuthzFilePath  string
 
+	// API key file or directory reloaded in interval, replacing APIKey
+	APIKeyFile           string
+	APIKeyReloadInterval time.Duration
+
+	// HTTPS serving. Client certificates are verified by TLSClientCA if
+	// TLSClientAuth is "optional" or "require"
+	TLSCert          string
+	TLSKey           string
+	TLSMinVersion    string
+	TLSClientCA      string
+	TLSClientAuth    string
+	HTTPRedirectPort int
+
+	// ReadHeaderTimeout closes connections of clients sending request
+	// header slowly not to hold the server, also while draining
+	ReadHeaderTimeout time.Duration
+
+	// Graceful shutdown. Readiness is turned off for ShutdownDelay before
+	// closing listeners, then active requests are drained within
+	// ShutdownTimeout
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+
+	// Tracing. Spans are exported by OTLP over HTTP or written to
+	// stdout or TraceFile
+	TraceExporter    string
+	TraceEndpoint    string
+	TraceFile        string
+	TraceSampleRatio float64
+
+	// TTL of cached reachability of Minerva in readiness check
+	ReadinessCacheTTL time.Duration
+
+	// Config file of multiple Minerva backends
+	BackendsPath string
+
+	// Authentication to Minerva given by endpoint argument, "api_key" or
+	// "sigv4"
+	UpstreamAuth string
+	AWSRegion    string
+	AWSRoleARN   string
+
+	// TLS and proxy of connection to Minerva given by endpoint argument
+	UpstreamCA            string
+	UpstreamCert          string
+	UpstreamKey           string
+	UpstreamServerName    string
+	UpstreamTLSMinVersion string
+	UpstreamProxy         string
+
+	// Timeouts, retries and circuit breaker of requests to Minerva
+	UpstreamDialTimeout    time.Duration
+	UpstreamHeaderTimeout  time.Duration
+	UpstreamTimeout        time.Duration
+	UpstreamRetries        int
+	UpstreamRetryBackoff   time.Duration
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+
+	// Remote authz table options
+	AuthzPollInterval time.Duration
+	AuthzPublicKey    string
+	AuthzFailClosed   bool
+
 	// Google OAuth options
 	GoogleOAuthConfig     string
 	GoogleOAuthConfigData string
 
 	// JWT
 	JWTSecret string
+
+	// Session cookie
+	CookieSecret string
+	CookieDomain string
+	CookieSecure bool
+
+	// Group resolver endpoint to get group memberships at login
+	GroupResolverURL string
+
+	// SCIM provisioning
+	SCIMToken     string
+	SCIMStorePath string
+
+	// Audit log sinks
+	AuditFilePath       string
+	AuditFileMaxSize    int
+	AuditFileMaxBackups int
+	AuditSyslog         string
+	AuditWebhook        string
+
+	// Anomaly detection over audit events
+	AnomalyDetection     bool
+	AnomalyWebhook       string
+	AnomalySensitiveTags string
+	AnomalySpikeFactor   float64
+	AnomalyBulkPages     int
+
+	// Default rate limit of each user, overridden by rate_limit of roles
+	RateLimit             float64
+	RateLimitBurst        int
+	MaxConcurrentSearches int
+
+	// Response cache of completed searches
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// Window to reuse an identical search (0 disables)
+	SearchDedupWindow time.Duration
+}
+
+func (x arguments) upstreamTLS() *upstreamTLS {
+	config := &upstreamTLS{
+		CAFile:     x.UpstreamCA,
+		CertFile:   x.UpstreamCert,
+		KeyFile:    x.UpstreamKey,
+		ServerName: x.UpstreamServerName,
+		MinVersion: x.UpstreamTLSMinVersion,
+	}
+	if *config == (upstreamTLS{}) {
+		return nil
+	}
+	return config
+}
+
+// setupAuthz loads authz table from file(s) or URL. A table from URL is
+// polled in background and replaced when it's changed.
+func setupAuthz(ctx context.Context, args arguments) (*authzHolder, error) {
+	if !isAuthzURL(args.AuthzFilePath) {
+		srv, err := newAuthzServiceFromPath(args.AuthzFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return newAuthzHolder(srv, args.AuthzFailClosed), nil
+	}
+
+	holder := newAuthzHolder(nil, args.AuthzFailClosed)
+	remote, err := newAuthzRemote(args.AuthzFilePath, args.AuthzPublicKey, holder)
+	if err != nil {
+		return nil, err
+	}
+	if err := remote.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if args.AuthzPollInterval > 0 {
+		go remote.poll(ctx, args.AuthzPollInterval)
+	}
+
+	return holder, nil
+}
+
+// setupAudit creates audit logger with configured sinks. Audit records are
+// written to the application logger if no sink is configured.
+func setupAudit(args arguments) (*auditLogger, error) {
+	var sinks []auditSink
+	var last *auditEvent
+
+	if args.AuditFilePath != "" {
+		sink, err := newFileAuditSink(args.AuditFilePath, int64(args.AuditFileMaxSize)*1024*1024, args.AuditFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		if last, err = sink.lastEvent(); err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if args.AuditSyslog != "" {
+		sink, err := newSyslogAuditSink(args.AuditSyslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if args.AuditWebhook != "" {
+		sinks = append(sinks, newWebhookAuditSink(args.AuditWebhook))
+	}
+
+	if len(sinks) == 0 {
+		sinks = append(sinks, &loggerAuditSink{})
+	}
+
+	audit := newAuditLogger(sinks...)
+	if last != nil {
+		audit.resume(last)
+	}
+
+	return audit, nil
+}
+
+// setupAnomaly starts anomaly detector observing audit events. Baseline of
+// search activity is built from audit log files if they are available.
+func setupAnomaly(args arguments, audit *auditLogger) error {
+	config := anomalyConfig{
+		SpikeFactor: args.AnomalySpikeFactor,
+		BulkPages:   args.AnomalyBulkPages,
+	}
+	for _, tag := range strings.Split(args.AnomalySensitiveTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			if _, err := path.Match(tag, ""); err != nil {
+				return errors.Wrapf(err, "Invalid sensitive tag pattern: %s", tag)
+			}
+			config.SensitiveTags = append(config.SensitiveTags, tag)
+		}
+	}
+
+	var sink anomalyAlertSink = &loggerAlertSink{}
+	if args.AnomalyWebhook != "" {
+		sink = newWebhookAlertSink(args.AnomalyWebhook)
+	}
+	detector := newAnomalyDetector(config, sink)
+
+	files, err := audit.files()
+	if err != nil {
+		return err
+	}
+	if err := detector.learn(files); err != nil {
+		return err
+	}
+
+	audit.subscribe(detector)
+	go detector.run()
+
+	return nil
 }
 
 func runServer(args arguments) error {
@@ -33,35 +267,142 @@ func runServer(args arguments) error {
 		return err
 	}
 
+	// SIGTERM or SIGINT starts graceful shutdown. Handling of the signals is
+	// stopped at the first one so that the second one forces exit while
+	// draining.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	state := &serverState{}
+
+	shutdownTracing, err := setupTracing(ctx, args)
+	if err != nil {
+		return err
+	}
+	// Spans are flushed after draining requests
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.WithError(err).Error("Fail to flush trace spans")
+		}
+	}()
+
+	basePath, err := normalizeBasePath(args.BasePath)
+	if err != nil {
+		return err
+	}
+	ui, err := newWebUI(args.StaticContents, basePath)
+	if err != nil {
+		return err
+	}
+
 	r := gin.Default()
-	store := cookie.NewStore([]byte("auth"))
+	r.Use(state.closeWhileDraining)
+	store := cookie.NewStore([]byte(args.CookieSecret))
+	store.Options(sessions.Options{
+		Path:     basePath,
+		Domain:   args.CookieDomain,
+		MaxAge:   86400 * 30,
+		Secure:   args.CookieSecure,
+		HttpOnly: true,
+	})
 	r.Use(sessions.Sessions("strix", store))
-	r.Use(static.Serve("/", static.LocalFile(args.StaticContents, false)))
+	r.NoRoute(ui.serve)
 
-	r.GET("/hello/revision", func(c *gin.Context) {
+	// Routes of web UI, auth, API and SCIM are under base path to run behind
+	// a shared ingress. Health check and metrics are not.
+	base := r.Group(basePath)
+	base.GET("/hello/revision", func(c *gin.Context) {
 		c.String(200, args.HelloReply)
 	})
 
 	// Setup session manager
-	authz, err := newAuthzServiceFromFile(args.AuthzFilePath)
+	authz, err := setupAuthz(ctx, args)
 	if err != nil {
 		return err
 	}
 
-	ssnMgr := newSessionManager(args.JWTSecret)
+	if args.SCIMToken != "" {
+		if args.SCIMStorePath == "" {
+			return fmt.Errorf("scim-store is required to enable SCIM provisioning")
+		}
+		scim, err := newScimStore(args.SCIMStorePath)
+		if err != nil {
+			return err
+		}
+		authz.directory = scim
+
+		if err := setupSCIM(scim, args.SCIMToken, base.Group("/scim/v2")); err != nil {
+			return err
+		}
+	}
+
+	audit, err := setupAudit(args)
+	if err != nil {
+		return err
+	}
+	// Audit records are flushed after draining requests
+	defer func() {
+		if err := audit.close(); err != nil {
+			logger.WithError(err).Error("Fail to flush audit log")
+		}
+	}()
+
+	if args.AnomalyDetection {
+		if err := setupAnomaly(args, audit); err != nil {
+			return err
+		}
+	}
+
+	ssnMgr := newSessionManager(args.JWTSecret, audit)
+	ssnMgr.basePath = basePath
+	if args.GroupResolverURL != "" {
+		resolver, err := newHTTPGroupResolver(args.GroupResolverURL)
+		if err != nil {
+			return err
+		}
+		ssnMgr.resolver = resolver
+	}
+
+	// requestID assigns ID to correlate audit events of a request, the
+	// upstream request, the response and the trace.
+	requestID := func(c *gin.Context) {
+		reqID := uuid.New().String()
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("strix.request_id", reqID))
+		c.Set("request_id", reqID)
+		c.Header("X-Request-Id", reqID)
+		c.Next()
+	}
+
 	authCheck := func(c *gin.Context) {
+		_, span := tracer().Start(c.Request.Context(), "authCheck")
 		user, err := ssnMgr.validate(c)
+		if err != nil && args.TLSClientAuth != "" && args.TLSClientAuth != clientAuthNone {
+			// Verified client certificate is an identity of the user
+			// without login
+			if certUser, certErr := ssnMgr.validateClientCert(c); certErr == nil {
+				user, err = certUser, nil
+			}
+		}
+		endSpan(span, err)
 		if err != nil {
 			logger.WithError(err).Warn("Authentication Fail")
-			c.JSON(http.StatusUnauthorized, gin.H{"msg": "Authentication failed"})
+			ev := newAuditEvent(c, auditAuthn, auditDeny)
+			ev.Reason = err.Error()
+			audit.log(ev)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "Authentication failed"})
 		} else {
 			c.Set("user", user.UserID)
+			c.Set("session", user)
 			c.Next()
 		}
 	}
 
 	// Auth route group
-	authGroup := r.Group("/auth")
+	authGroup := base.Group("/auth")
+	authGroup.Use(tracingMiddleware, requestID)
 	if err := setupAuth(ssnMgr, authGroup); err != nil {
 		return err
 	}
@@ -77,16 +418,33 @@ func runServer(args arguments) error {
 	}
 
 	// API route group
-	apiGroup := r.Group("/api/v1")
-	apiGroup.Use(authCheck)
-	if err := setupAPI(authz, args.APIKey, args.Endpoint, apiGroup); err != nil {
+	apiGroup := base.Group("/api/v1")
+	apiGroup.Use(metricsMiddleware, tracingMiddleware, requestID, authCheck)
+	limiter := newRateLimiter(newMemoryRateLimitStore(), rateLimit{
+		PerMinute:     args.RateLimit,
+		Burst:         args.RateLimitBurst,
+		MaxConcurrent: args.MaxConcurrentSearches,
+	})
+	cache := newResponseCache(args.CacheTTL, int64(args.CacheSize)*1024*1024)
+	dedup := newSearchDedup(args.SearchDedupWindow)
+	backends, err := setupBackends(args)
+	if err != nil {
+		return err
+	}
+	if err := setupAPI(authz, audit, limiter, cache, dedup, backends, apiGroup); err != nil {
 		return err
 	}
 
-	// Start server
-	if err := r.Run(fmt.Sprintf("%s:%d", args.BindAddress, args.BindPort)); err != nil {
+	if err := setupMetrics(audit, limiter, r); err != nil {
 		return err
 	}
 
-	return nil
+	setupHealth(&readiness{
+		state: state,
+		authz: authz,
+		probe: newBackendProbe(backends, args.ReadinessCacheTTL),
+	}, r)
+
+	// Start server
+	return serve(ctx, args, r, state)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Verification mode of client certificates
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+func (x arguments) serveTLS() bool {
+	return x.TLSCert != "" || x.TLSKey != ""
+}
+
+// newServerTLSConfig builds TLS config of the server. Certificate is
+// reloaded when the files are modified. Client certificates signed by
+// client CA are verified if client auth is "optional" or "require".
+func newServerTLSConfig(args arguments) (*tls.Config, error) {
+	if args.TLSCert == "" || args.TLSKey == "" {
+		return nil, fmt.Errorf("Both of tls-cert and tls-key are required to serve HTTPS")
+	}
+
+	minVersion, err := parseTLSVersion(args.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(args.TLSCert, args.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.certificate()
+		},
+	}
+
+	switch args.TLSClientAuth {
+	case "", clientAuthNone:
+		return config, nil
+	case clientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Invalid tls-client-auth: '%s', must be one of none, optional and require", args.TLSClientAuth)
+	}
+
+	if args.TLSClientCA == "" {
+		return nil, fmt.Errorf("tls-client-ca is required to verify client certificates")
+	}
+	if config.ClientCAs, err = loadCertPool(args.TLSClientCA); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// clientCertUser returns a user identified by verified client certificate.
+// User ID is the first email address of SAN or common name, and
+// organizational units are groups of the user.
+func clientCertUser(req *http.Request) *strixUser {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	user := &strixUser{
+		UserID:    cert.Subject.CommonName,
+		Groups:    append([]string{}, cert.Subject.OrganizationalUnit...),
+		ExpiresAt: cert.NotAfter,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		user.UserID = cert.EmailAddresses[0]
+	}
+	if user.UserID == "" {
+		return nil
+	}
+
+	return user
+}
+
+// validateClientCert authenticates a user by client certificate. Groups are
+// merged with ones of group resolver.
+func (x *sessionManager) validateClientCert(c *gin.Context) (*strixUser, error) {
+	user := clientCertUser(c.Request)
+	if user == nil {
+		return nil, fmt.Errorf("no client certificate")
+	}
+
+	groups, err := x.groups(c.Request.Context(), user.UserID, user.Groups)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to resolve groups of %s", user.UserID)
+	}
+	user.Groups = groups
+
+	return user, nil
+}
+
+// redirectHTTPS redirects plain HTTP requests to HTTPS port.
+func redirectHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
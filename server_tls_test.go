@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, ca.pem, 0600))
+
+	writeServerCert := func(cn string, modTime time.Time) {
+		cert, key := ca.issue(t, cn, x509.ExtKeyUsageServerAuth)
+		require.NoError(t, ioutil.WriteFile(certFile, cert, 0600))
+		require.NoError(t, ioutil.WriteFile(keyFile, key, 0600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeServerCert("strix-1.example.com", time.Now().Add(-time.Minute))
+
+	config, err := main.NewServerTLSConfig(main.Arguments{
+		TLSCert:       certFile,
+		TLSKey:        keyFile,
+		TLSClientAuth: "optional",
+		TLSClientCA:   caFile,
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.TLS = config
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	get := func(serverName string) (string, *tls.ConnectionState, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: serverName},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS, nil
+	}
+
+	t.Run("HTTP/2 is served", func(t *testing.T) {
+		body, _, err := get("strix-1.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", body)
+	})
+
+	t.Run("server certificate is reloaded", func(t *testing.T) {
+		writeServerCert("strix-2.example.com", time.Now())
+		_, state, err := get("strix-2.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "strix-2.example.com", state.PeerCertificates[0].Subject.CommonName)
+	})
+
+	t.Run("client certificate is required", func(t *testing.T) {
+		config, err := main.NewServerTLSConfig(main.Arguments{
+			TLSCert:       certFile,
+			TLSKey:        keyFile,
+			TLSClientAuth: "require",
+			TLSClientCA:   caFile,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+		_, err = main.NewServerTLSConfig(main.Arguments{TLSCert: certFile, TLSKey: keyFile, TLSClientAuth: "require"})
+		assert.Error(t, err)
+		_, err = main.NewServerTLSConfig(main.Arguments{TLSCert: certFile, TLSKey: keyFile, TLSClientAuth: "always"})
+		assert.Error(t, err)
+	})
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	cases := []struct {
+		host     string
+		port     int
+		location string
+	}{
+		{"strix.example.com", 443, "https://strix.example.com/api/v1/me?x=1"},
+		{"strix.example.com:8080", 8443, "https://strix.example.com:8443/api/v1/me?x=1"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/api/v1/me?x=1", nil)
+		w := httptest.NewRecorder()
+		main.RedirectHTTPS(tc.port).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, tc.location, w.Header().Get("Location"))
+	}
+}
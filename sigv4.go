@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/pkg/errors"
+)
+
+const (
+	upstreamAuthAPIKey = "api_key"
+	upstreamAuthSigV4  = "sigv4"
+
+	// sigV4DefaultService is service name of API Gateway in SigV4 signature
+	sigV4DefaultService = "execute-api"
+)
+
+// newSigV4Credentials loads AWS credentials by the default chain, i.e.
+// environment variables, shared credentials file and instance role. If
+// roleARN is given, the credentials are used to assume the role.
+func newSigV4Credentials(ctx context.Context, region, roleARN string) (aws.CredentialsProvider, string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Fail to load AWS config")
+	}
+	if cfg.Region == "" {
+		return nil, "", errors.New("AWS region is required for SigV4 signing")
+	}
+
+	creds := cfg.Credentials
+	if roleARN != "" {
+		creds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(opt *stscreds.AssumeRoleOptions) {
+			opt.RoleSessionName = "strix"
+		}))
+	}
+
+	return creds, cfg.Region, nil
+}
+
+// sigV4Transport signs each request with SigV4 before sending it. Request
+// body is buffered to calculate the payload hash.
+type sigV4Transport struct {
+	base        http.RoundTripper
+	signer      *v4.Signer
+	credentials aws.CredentialsProvider
+	region      string
+	service     string
+}
+
+func newSigV4Transport(base http.RoundTripper, credentials aws.CredentialsProvider, region, service string) *sigV4Transport {
+	if service == "" {
+		service = sigV4DefaultService
+	}
+	return &sigV4Transport{
+		base:        base,
+		signer:      v4.NewSigner(),
+		credentials: credentials,
+		region:      region,
+		service:     service,
+	}
+}
+
+func (x *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		raw, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to read request body for signing")
+		}
+		body = raw
+	}
+
+	// RoundTripper must not modify the original request
+	signed := req.Clone(req.Context())
+	signed.ContentLength = int64(len(body))
+	signed.Body = http.NoBody
+	if len(body) > 0 {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+		signed.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	creds, err := x.credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to retrieve AWS credentials")
+	}
+
+	hash := sha256.Sum256(body)
+	if err := x.signer.SignHTTP(req.Context(), creds, signed, hex.EncodeToString(hash[:]), x.service, x.region, time.Now()); err != nil {
+		return nil, errors.Wrap(err, "Fail to sign request")
+	}
+
+	return x.base.RoundTrip(signed)
+}
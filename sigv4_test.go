@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifySigV4 re-signs the request with headers listed in SignedHeaders and
+// compares the signature.
+func verifySigV4(r *http.Request, creds aws.Credentials, region string) bool {
+	auth := r.Header.Get("Authorization")
+	idx := strings.Index(auth, "SignedHeaders=")
+	if idx < 0 {
+		return false
+	}
+	signedHeaders := strings.Split(strings.SplitN(auth[idx+len("SignedHeaders="):], ",", 2)[0], ";")
+
+	signedAt, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != "" && r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		return false
+	}
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+	for _, h := range signedHeaders {
+		if h != "host" && h != "content-length" {
+			req.Header.Set(h, r.Header.Get(h))
+		}
+	}
+	req.Header.Del("Authorization")
+	if err := v4.NewSigner().SignHTTP(context.Background(), creds, req, hex.EncodeToString(hash[:]), "execute-api", region, signedAt); err != nil {
+		return false
+	}
+	return req.Header.Get("Authorization") == auth
+}
+
+func TestSigV4(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	creds := aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+	var apiKeys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKeys = append(apiKeys, r.Header.Get("x-api-key"))
+		if !verifySigV4(r, creds, "ap-northeast-1") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: srv.URL + "/prod", Auth: "sigv4", Region: "ap-northeast-1"},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodPost, "/api/v1/search", `{"query":[{"term":"x"}]}`))
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1/logs?offset=0&limit=50", ""))
+	assert.Equal(t, []string{"", ""}, apiKeys)
+
+	t.Run("wrong region", func(t *testing.T) {
+		other, err := main.NewBackendRouter(&main.BackendConfig{
+			Backends: []*main.MinervaBackend{
+				{Name: "tokyo", Endpoint: srv.URL + "/prod", Auth: "sigv4", Region: "us-east-1"},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, main.BackendDo(other, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	})
+
+	t.Run("invalid auth", func(t *testing.T) {
+		_, err := main.NewBackendRouter(&main.BackendConfig{
+			Backends: []*main.MinervaBackend{
+				{Name: "tokyo", Endpoint: srv.URL + "/prod", Auth: "basic"},
+			},
+		})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upstreamTLS is TLS options of connection to a backend, e.g. a private API
+// Gateway with an internal CA requiring client certificate.
+type upstreamTLS struct {
+	CAFile     string `json:"ca_file" yaml:"ca_file"`
+	CertFile   string `json:"cert_file" yaml:"cert_file"`
+	KeyFile    string `json:"key_file" yaml:"key_file"`
+	ServerName string `json:"server_name" yaml:"server_name"`
+	MinVersion string `json:"min_version" yaml:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("Invalid TLS version: '%s', must be one of 1.0, 1.1, 1.2 and 1.3", version)
+	}
+	return v, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read CA bundle: %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("No certificate in CA bundle: %s", caFile)
+	}
+	return pool, nil
+}
+
+// certReloader provides a certificate and key pair, reloading them when the
+// files are modified. Modification is checked at TLS handshake.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	x := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := x.certificate(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, fpath := range []string{x.certFile, x.keyFile} {
+		stat, err := os.Stat(fpath)
+		if err != nil {
+			return last, errors.Wrapf(err, "Fail to read certificate: %s", fpath)
+		}
+		if stat.ModTime().After(last) {
+			last = stat.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// certificate returns the current certificate. The loaded one is kept if the
+// files can not be loaded, e.g. while being replaced.
+func (x *certReloader) certificate() (*tls.Certificate, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	modTime, err := x.lastModified()
+	if err == nil && x.cert != nil && modTime.Equal(x.modTime) {
+		return x.cert, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(x.certFile, x.keyFile)
+		if err == nil {
+			if x.cert != nil {
+				logger.WithField("cert", x.certFile).Info("Certificate reloaded")
+			}
+			x.cert, x.modTime = &cert, modTime
+			return x.cert, nil
+		}
+		err = errors.Wrapf(err, "Fail to load certificate: %s", x.certFile)
+	}
+
+	if x.cert == nil {
+		return nil, err
+	}
+	logger.WithError(err).Warn("Fail to reload certificate, keep current one")
+	return x.cert, nil
+}
+
+func (x *upstreamTLS) config() (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(x.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: x.ServerName,
+	}
+
+	if x.CAFile != "" {
+		if config.RootCAs, err = loadCertPool(x.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if x.CertFile != "" || x.KeyFile != "" {
+		if x.CertFile == "" || x.KeyFile == "" {
+			return nil, fmt.Errorf("Both of client certificate and key are required")
+		}
+		reloader, err := newCertReloader(x.CertFile, x.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.certificate()
+		}
+	}
+
+	return config, nil
+}
+
+// configureTransport applies TLS and proxy options of the backend to
+// transport. Proxy of environment variables (HTTPS_PROXY etc.) is used if
+// proxy is not set.
+func (x *minervaBackend) configureTransport(transport *http.Transport) error {
+	if x.TLS != nil {
+		config, err := x.TLS.config()
+		if err != nil {
+			return errors.Wrapf(err, "Invalid TLS option of backend %s", x.Name)
+		}
+		transport.TLSClientConfig = config
+	}
+
+	if x.Proxy != "" {
+		u, err := url.Parse(x.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid proxy of backend %s: '%s'", x.Name, x.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return nil
+}
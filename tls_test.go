@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})}
+}
+
+// issue returns PEM of certificate and key signed by the CA.
+func (x *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, x.cert, &key.PublicKey, x.key)
+	require.NoError(t, err)
+	keyRaw, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyRaw})
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, ca.pem, 0600))
+
+	writeClientCert := func(cn string, modTime time.Time) {
+		cert, key := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+		require.NoError(t, ioutil.WriteFile(certFile, cert, 0600))
+		require.NoError(t, ioutil.WriteFile(keyFile, key, 0600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeClientCert("strix-1", time.Now().Add(-time.Minute))
+
+	// Minerva stub behind private CA requiring client certificate
+	var clients []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients = append(clients, r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusOK)
+	}))
+	serverCert, serverKey := ca.issue(t, "minerva.internal", x509.ExtKeyUsageServerAuth)
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	newRouter := func(config *main.UpstreamTLS) (*main.BackendRouter, error) {
+		return main.NewBackendRouter(&main.BackendConfig{
+			Backends: []*main.MinervaBackend{
+				{Name: "private", Endpoint: srv.URL, APIKey: "private-key", TLS: config},
+			},
+		})
+	}
+
+	router, err := newRouter(&main.UpstreamTLS{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "minerva.internal",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "private", http.MethodGet, "/api/v1/search/s1", ""))
+
+	t.Run("client certificate is reloaded", func(t *testing.T) {
+		writeClientCert("strix-2", time.Now())
+		assert.Equal(t, http.StatusOK, main.BackendDo(router, "private", http.MethodGet, "/api/v1/search/s1", ""))
+		assert.Equal(t, []string{"strix-1", "strix-2"}, clients)
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		router, err := newRouter(&main.UpstreamTLS{CAFile: caFile, ServerName: "minerva.internal"})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, main.BackendDo(router, "private", http.MethodGet, "/api/v1/search/s1", ""))
+	})
+
+	t.Run("without server name", func(t *testing.T) {
+		router, err := newRouter(&main.UpstreamTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, main.BackendDo(router, "private", http.MethodGet, "/api/v1/search/s1", ""))
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := newRouter(&main.UpstreamTLS{CertFile: certFile})
+		assert.Error(t, err)
+		_, err = newRouter(&main.UpstreamTLS{MinVersion: "1.4"})
+		assert.Error(t, err)
+		_, err = newRouter(&main.UpstreamTLS{CAFile: certFile + ".none"})
+		assert.Error(t, err)
+	})
+}
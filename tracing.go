@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of trace spans
+const (
+	traceExporterNone   = "none"
+	traceExporterOTLP   = "otlp"
+	traceExporterStdout = "stdout"
+)
+
+const tracerName = "github.com/m-mizutani/strix"
+
+// tracePropagator reads and writes W3C traceparent header. It's used even if
+// tracing is disabled to pass trace context of clients through to Minerva.
+var tracePropagator = propagation.TraceContext{}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// endSpan records err to span if it's not nil and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceID returns ID of the current trace or empty string.
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+func newTraceExporter(ctx context.Context, args arguments) (sdktrace.SpanExporter, error) {
+	switch args.TraceExporter {
+	case traceExporterOTLP:
+		// Endpoint and headers are also configured by standard environment
+		// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT
+		var options []otlptracehttp.Option
+		if args.TraceEndpoint != "" {
+			u, err := url.Parse(args.TraceEndpoint)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("Invalid trace-endpoint: '%s'", args.TraceEndpoint)
+			}
+			options = append(options, otlptracehttp.WithEndpoint(u.Host))
+			if u.Scheme == "http" {
+				options = append(options, otlptracehttp.WithInsecure())
+			}
+			if u.Path != "" && u.Path != "/" {
+				options = append(options, otlptracehttp.WithURLPath(u.Path))
+			}
+		}
+		exporter, err := otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to create OTLP trace exporter")
+		}
+		return exporter, nil
+
+	case traceExporterStdout:
+		options := []stdouttrace.Option{}
+		if args.TraceFile != "" {
+			fd, err := os.OpenFile(args.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Fail to open trace file: %s", args.TraceFile)
+			}
+			options = append(options, stdouttrace.WithWriter(fd))
+		}
+		return stdouttrace.New(options...)
+
+	default:
+		return nil, fmt.Errorf("Invalid trace-exporter: '%s', must be one of none, otlp and stdout", args.TraceExporter)
+	}
+}
+
+// setupTracing configures the global tracer provider. The returned function
+// flushes buffered spans at shutdown. Spans are not recorded if exporter is
+// "none".
+func setupTracing(ctx context.Context, args arguments) (func(context.Context) error, error) {
+	if args.TraceExporter == "" || args.TraceExporter == traceExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+	if args.TraceSampleRatio < 0 || args.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("trace-sample-ratio must be between 0 and 1: %f", args.TraceSampleRatio)
+	}
+
+	exporter, err := newTraceExporter(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	version := getVersionInfo()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(args.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "strix"),
+			attribute.String("service.version", version.GitCommit),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	logger.WithFields(logrus.Fields{
+		"exporter":     args.TraceExporter,
+		"sample_ratio": args.TraceSampleRatio,
+	}).Info("Tracing enabled")
+
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span of the request continuing trace of
+// traceparent header.
+func tracingMiddleware(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx := tracePropagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer().Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.route", route),
+		))
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if backend := c.GetString("backend"); backend != "" {
+		span.SetAttributes(attribute.String("strix.backend", backend))
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// tracingTransport records a client span of each request attempt to a
+// backend and propagates trace context by traceparent header. The span ends
+// when response header is received.
+type tracingTransport struct {
+	base    http.RoundTripper
+	backend string
+}
+
+func (x *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "minerva "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("strix.backend", x.backend),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		))
+
+	traced := req.Clone(ctx)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(traced.Header))
+
+	resp, err := x.base.RoundTrip(traced)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
+	}
+	endSpan(span, err)
+
+	return resp, err
+}
@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"search_id":"s1"}`))
+	}))
+	defer upstream.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: upstream.URL, APIKey: "tokyo-key"},
+		},
+	})
+	require.NoError(t, err)
+
+	srv, err := main.NewAuthzService([]byte(`{
+		"roles": [{"name": "analyst", "permitted_tags": ["web"]}],
+		"users": [{"user_id": "blue@example.com", "role": "analyst"}]
+	}`))
+	require.NoError(t, err)
+
+	handler := main.NewTracingServer(main.NewAuthzHolder(srv, false), router)
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/api/v1/search", strings.NewReader(`{"query":[]}`))
+	require.NoError(t, err)
+	req.Header.Set("X-User", "blue@example.com")
+	req.Header.Set("traceparent", "00-"+clientTraceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		assert.Equal(t, clientTraceID, span.SpanContext().TraceID().String(), span.Name())
+	}
+	require.Contains(t, spans, "POST /api/v1/search")
+	require.Contains(t, spans, "authz.lookup")
+	require.Contains(t, spans, "minerva POST")
+
+	// Upstream request is a child of the client span
+	client := spans["minerva POST"]
+	assert.Equal(t, spans["POST /api/v1/search"].SpanContext().SpanID(), client.Parent().SpanID())
+	assert.Equal(t, "00-"+clientTraceID+"-"+client.SpanContext().SpanID().String()+"-01", traceparent)
+}
+
+func TestSetupTracingFile(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	fpath := filepath.Join(t.TempDir(), "trace.json")
+	shutdown, err := main.SetupTracing(context.Background(), main.Arguments{
+		TraceExporter:    "stdout",
+		TraceFile:        fpath,
+		TraceSampleRatio: 1,
+	})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "offline-span")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	raw, err := ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"Name":"offline-span"`)
+
+	_, err = main.SetupTracing(context.Background(), main.Arguments{TraceExporter: "jaeger"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamConfig controls requests to Minerva backends. Zero value of a
+// field disables the feature.
+type upstreamConfig struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	// Timeout covers a whole request including retries until response
+	// header arrives. Response body is not limited not to cut off streaming
+	// of large logs.
+	Timeout time.Duration
+
+	// Retries is max number of retries of GET requests failed by network
+	// error or 502, 503 and 504. RetryBackoff is the base wait before the
+	// first retry and doubled for each retry with jitter.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Circuit breaker opens after BreakerFailures consecutive failures and
+	// allows a trial request after BreakerCooldown.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+func newUpstreamTransport(config upstreamConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	return transport
+}
+
+// retryBackoff returns jittered wait before retry, between half and full of
+// exponential backoff.
+func (x upstreamConfig) retryBackoff(attempt int) time.Duration {
+	backoff := float64(x.RetryBackoff) * math.Pow(2, float64(attempt))
+	return time.Duration(backoff/2 + rand.Float64()*backoff/2)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops requests to a backend failing continuously so that
+// clients get an error immediately instead of waiting for timeout.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns false and time to wait if the circuit is open. Only one
+// trial request is allowed while half-open.
+func (x *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	if x == nil || x.threshold <= 0 {
+		return true, 0
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	switch x.state {
+	case breakerOpen:
+		if elapsed := now.Sub(x.openedAt); elapsed < x.cooldown {
+			return false, x.cooldown - elapsed
+		}
+		x.state = breakerHalfOpen
+		return true, 0
+	case breakerHalfOpen:
+		return false, x.cooldown
+	default:
+		return true, 0
+	}
+}
+
+func (x *circuitBreaker) success() {
+	if x == nil || x.threshold <= 0 {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.state != breakerClosed {
+		logger.WithField("backend", x.name).Info("Circuit breaker closed")
+	}
+	x.state = breakerClosed
+	x.failures = 0
+}
+
+func (x *circuitBreaker) failure(now time.Time) {
+	if x == nil || x.threshold <= 0 {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.failures++
+	if x.state == breakerHalfOpen || x.failures >= x.threshold {
+		if x.state != breakerOpen {
+			logger.WithFields(logrus.Fields{
+				"backend":  x.name,
+				"failures": x.failures,
+			}).Warn("Circuit breaker opened")
+		}
+		x.state = breakerOpen
+		x.openedAt = now
+	}
+}
+
+// abandon is called when a request ended without result, e.g. canceled by
+// client. A trial request of half-open circuit is allowed again.
+func (x *circuitBreaker) abandon() {
+	if x == nil || x.threshold <= 0 {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.state == breakerHalfOpen {
+		x.state = breakerOpen
+	}
+}
+
+// errCircuitOpen is returned instead of calling a backend while its circuit
+// is open.
+type errCircuitOpen struct {
+	backend    string
+	retryAfter time.Duration
+}
+
+func (x *errCircuitOpen) Error() string {
+	return fmt.Sprintf("Backend %s is temporarily unavailable", x.backend)
+}
+
+func isUpstreamFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases timeout context of a request when response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (x *cancelOnClose) Close() error {
+	err := x.ReadCloser.Close()
+	x.cancel()
+	return err
+}
+
+// sendUpstream sends req to a backend with timeout, circuit breaker and
+// retries of GET requests.
+func sendUpstream(transport http.RoundTripper, breaker *circuitBreaker, config upstreamConfig, name string, req *http.Request) (*http.Response, error) {
+	// The timer is stopped when response header arrives. Cause of the
+	// context tells timeout from cancel of the client.
+	ctx, cancelCause := context.WithCancelCause(req.Context())
+	cancel := func() { cancelCause(nil) }
+	stopTimer := func() bool { return true }
+	if config.Timeout > 0 {
+		stopTimer = time.AfterFunc(config.Timeout, func() { cancelCause(context.DeadlineExceeded) }).Stop
+	}
+	req = req.WithContext(ctx)
+
+	retries := 0
+	if req.Method == http.MethodGet && (req.Body == nil || req.Body == http.NoBody) {
+		retries = config.Retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if ok, wait := breaker.allow(time.Now()); !ok {
+			cancel()
+			return nil, &errCircuitOpen{backend: name, retryAfter: wait}
+		}
+
+		start := time.Now()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			observeUpstream(name, req.Method, 0, err, time.Since(start))
+		} else {
+			observeUpstream(name, req.Method, resp.StatusCode, nil, time.Since(start))
+		}
+		switch {
+		case context.Cause(ctx) == context.Canceled:
+			breaker.abandon()
+		case isUpstreamFailure(resp, err):
+			breaker.failure(time.Now())
+		default:
+			breaker.success()
+		}
+
+		if !isUpstreamFailure(resp, err) || attempt >= retries || ctx.Err() != nil {
+			if err != nil {
+				cancel()
+				if context.Cause(ctx) == context.DeadlineExceeded {
+					return nil, context.DeadlineExceeded
+				}
+				return nil, err
+			}
+			stopTimer()
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		wait := config.retryBackoff(attempt)
+		logger.WithFields(logrus.Fields{
+			"backend": name,
+			"path":    req.URL.Path,
+			"attempt": attempt + 1,
+			"wait":    wait,
+		}).WithError(err).Warn("Retry upstream request")
+
+		select {
+		case <-ctx.Done():
+			cause := context.Cause(ctx)
+			cancel()
+			return nil, cause
+		case <-time.After(wait):
+		}
+	}
+}
+
+// upstreamError returns status and message for an error of an upstream
+// request.
+func upstreamError(err error) (int, string) {
+	var circuit *errCircuitOpen
+	if errors.As(err, &circuit) {
+		return http.StatusServiceUnavailable, circuit.Error()
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, "Backend timed out"
+	}
+
+	return http.StatusBadGateway, "Fail to connect backend"
+}
+
+// upstreamErrorHandler is ErrorHandler of reverse proxy to return an error
+// as JSON.
+func upstreamErrorHandler(backend string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		status, msg := upstreamError(err)
+
+		logger.WithFields(logrus.Fields{
+			"backend": backend,
+			"path":    req.URL.Path,
+			"status":  status,
+		}).WithError(err).Error("Upstream request failed")
+
+		var circuit *errCircuitOpen
+		if errors.As(err, &circuit) {
+			sec := int(math.Ceil(circuit.retryAfter.Seconds()))
+			if sec < 1 {
+				sec = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(sec))
+		}
+
+		jsonResponse(status, gin.H{"msg": msg, "backend": backend}).writeTo(w)
+	}
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUpstream returns a router of backend "tokyo" returning status of
+// respond for each call and counter of calls.
+func newUpstream(t *testing.T, config main.UpstreamConfig, respond func(n int32) int) (*main.BackendRouter, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(respond(atomic.AddInt32(&calls, 1)))
+	}))
+	t.Cleanup(srv.Close)
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: srv.URL, APIKey: "tokyo-key"},
+		},
+		Upstream: config,
+	})
+	require.NoError(t, err)
+	return router, &calls
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	config := main.UpstreamConfig{Retries: 2, RetryBackoff: time.Millisecond}
+	unavailableTwice := func(n int32) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+
+	t.Run("GET is retried", func(t *testing.T) {
+		router, calls := newUpstream(t, config, unavailableTwice)
+		assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+		assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	})
+
+	t.Run("POST is not retried", func(t *testing.T) {
+		router, calls := newUpstream(t, config, unavailableTwice)
+		assert.Equal(t, http.StatusServiceUnavailable, main.BackendDo(router, "tokyo", http.MethodPost, "/api/v1/search", ""))
+		assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	})
+
+	t.Run("client error is not retried", func(t *testing.T) {
+		router, calls := newUpstream(t, config, func(n int32) int { return http.StatusNotFound })
+		assert.Equal(t, http.StatusNotFound, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+		assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	})
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	var healthy int32
+	config := main.UpstreamConfig{BreakerFailures: 2, BreakerCooldown: 50 * time.Millisecond}
+	router, calls := newUpstream(t, config, func(n int32) int {
+		if atomic.LoadInt32(&healthy) == 1 {
+			return http.StatusOK
+		}
+		return http.StatusBadGateway
+	})
+
+	assert.Equal(t, http.StatusBadGateway, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, http.StatusBadGateway, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+
+	// Circuit is open and the backend is not called
+	assert.Equal(t, http.StatusServiceUnavailable, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+
+	// A trial request after cooldown closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, http.StatusOK, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+	assert.Equal(t, int32(4), atomic.LoadInt32(calls))
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	config := main.UpstreamConfig{Timeout: 20 * time.Millisecond}
+	router, _ := newUpstream(t, config, func(n int32) int {
+		time.Sleep(200 * time.Millisecond)
+		return http.StatusOK
+	})
+
+	assert.Equal(t, http.StatusGatewayTimeout, main.BackendDo(router, "tokyo", http.MethodGet, "/api/v1/search/s1", ""))
+}
+
+func TestUpstreamTimeoutStreaming(t *testing.T) {
+	// Body streamed longer than the timeout is not cut off
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk;"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	router, err := main.NewBackendRouter(&main.BackendConfig{
+		Backends: []*main.MinervaBackend{
+			{Name: "tokyo", Endpoint: srv.URL, APIKey: "tokyo-key"},
+		},
+		Upstream: main.UpstreamConfig{Timeout: 50 * time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	body, err := main.BackendRead(router, "tokyo", "/api/v1/search/s1/logs")
+	require.NoError(t, err)
+	assert.Equal(t, "chunk;chunk;chunk;chunk;chunk;", body)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Built web UI. Run "make build" to build the frontend before go build.
+//
+//go:embed static
+var embeddedWeb embed.FS
+
+const (
+	webIndexFile = "index.html"
+
+	// Assets requested with the current content hash never change
+	cacheControlImmutable = "public, max-age=31536000, immutable"
+	cacheControlNoCache   = "no-cache"
+)
+
+// normalizeBasePath returns base path having leading and trailing slash,
+// e.g. "/strix/".
+func normalizeBasePath(basePath string) (string, error) {
+	u, err := url.Parse(basePath)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid base-path: '%s'", basePath)
+	}
+
+	p := path.Clean("/" + u.Path)
+	if p != "/" {
+		p += "/"
+	}
+	return p, nil
+}
+
+// withBasePath puts base path before path of URL, e.g. OAuth redirect URL
+// http://localhost:9080/auth/google/callback becomes
+// http://localhost:9080/strix/auth/google/callback. URL already having the
+// base path is not changed.
+func withBasePath(rawURL, basePath string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid URL: %s", rawURL)
+	}
+	if strings.HasPrefix(u.Path, basePath) {
+		return rawURL, nil
+	}
+
+	u.Path = basePath + strings.TrimPrefix(u.Path, "/")
+	return u.String(), nil
+}
+
+// webUI serves the frontend under base path. Files are embedded in the
+// binary or read from a directory for development. index.html is a template
+// to set base path and URLs of assets with content hash.
+type webUI struct {
+	files    fs.FS
+	basePath string
+	index    *template.Template
+	modTime  time.Time
+
+	// Content hashes of files, only for embedded files because files in a
+	// directory may be modified
+	hashes map[string]string
+}
+
+// newWebUI returns web UI of embedded files, or files in dir if it's set.
+func newWebUI(dir, basePath string) (*webUI, error) {
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, errors.Wrapf(err, "Fail to read static contents: %s", dir)
+		}
+		logger.WithField("path", dir).Info("Serve web UI from directory")
+		return newWebUIFS(os.DirFS(dir), basePath, false)
+	}
+
+	files, err := fs.Sub(embeddedWeb, "static")
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read embedded web UI")
+	}
+	return newWebUIFS(files, basePath, true)
+}
+
+// newWebUIFS returns web UI of files. Content hashes are calculated if the
+// files are immutable.
+func newWebUIFS(files fs.FS, basePath string, immutable bool) (*webUI, error) {
+	ui := &webUI{files: files, basePath: basePath, modTime: time.Now()}
+
+	if immutable {
+		hashes, err := hashFiles(files)
+		if err != nil {
+			return nil, err
+		}
+		ui.hashes = hashes
+	}
+
+	if _, err := ui.template(); err != nil {
+		return nil, err
+	}
+
+	return ui, nil
+}
+
+func hashFiles(files fs.FS) (map[string]string, error) {
+	hashes := map[string]string{}
+	err := fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		raw, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(raw)
+		hashes[name] = hex.EncodeToString(h[:])[:16]
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to hash web UI files")
+	}
+	return hashes, nil
+}
+
+// dev returns true if files are read from a directory.
+func (x *webUI) dev() bool {
+	return x.hashes == nil
+}
+
+// asset returns URL of a file relative to base path, with content hash if
+// it's known.
+func (x *webUI) asset(name string) string {
+	if hash, ok := x.hashes[name]; ok {
+		return name + "?v=" + hash
+	}
+	return name
+}
+
+// template returns parsed index.html. It's parsed at every request in
+// development to reflect modification.
+func (x *webUI) template() (*template.Template, error) {
+	if x.index != nil {
+		return x.index, nil
+	}
+
+	raw, err := fs.ReadFile(x.files, webIndexFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read %s of web UI", webIndexFile)
+	}
+	tmpl, err := template.New(webIndexFile).Funcs(template.FuncMap{"asset": x.asset}).Parse(string(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse %s of web UI", webIndexFile)
+	}
+
+	if !x.dev() {
+		x.index = tmpl
+	}
+	return tmpl, nil
+}
+
+func (x *webUI) serveIndex(c *gin.Context) {
+	tmpl, err := x.template()
+	if err != nil {
+		logger.WithError(err).Error("Fail to load web UI")
+		c.String(http.StatusInternalServerError, "Fail to load web UI")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, gin.H{"BasePath": x.basePath}); err != nil {
+		logger.WithError(err).Error("Fail to render web UI")
+		c.String(http.StatusInternalServerError, "Fail to render web UI")
+		return
+	}
+
+	c.Header("Cache-Control", cacheControlNoCache)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// serve serves a file of web UI. It's a handler of requests not matched
+// with other routes.
+func (x *webUI) serve(c *gin.Context) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	reqPath := c.Request.URL.Path
+	if reqPath+"/" == x.basePath {
+		c.Redirect(http.StatusMovedPermanently, x.basePath)
+		return
+	}
+	if !strings.HasPrefix(reqPath, x.basePath) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(reqPath, x.basePath)), "/")
+	if name == "" || name == webIndexFile {
+		x.serveIndex(c)
+		return
+	}
+
+	f, err := x.files.Open(name)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	content, ok := f.(io.ReadSeeker)
+	if err != nil || stat.IsDir() || !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	modTime := stat.ModTime()
+	if hash, ok := x.hashes[name]; ok {
+		// Embedded files have no modification time
+		modTime = x.modTime
+		c.Header("ETag", `"`+hash+`"`)
+		if c.Query("v") == hash {
+			c.Header("Cache-Control", cacheControlImmutable)
+		} else {
+			c.Header("Cache-Control", cacheControlNoCache)
+		}
+	} else {
+		c.Header("Cache-Control", cacheControlNoCache)
+	}
+
+	http.ServeContent(c.Writer, c.Request, name, modTime, content)
+}
@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	main "github.com/m-mizutani/strix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebUI(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html":   {Data: []byte(`<base href="{{ .BasePath }}"><script src="{{ asset "js/bundle.js" }}"></script>`)},
+		"js/bundle.js": {Data: []byte(`console.log("strix")`)},
+	}
+
+	get := func(t *testing.T, h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("embedded with base path", func(t *testing.T) {
+		h, err := main.NewWebHandler(files, "/strix/", true)
+		require.NoError(t, err)
+
+		w := get(t, h, "/strix/")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+		assert.Regexp(t, `^<base href="/strix/"><script src="js/bundle.js\?v=[0-9a-f]{16}"></script>$`, w.Body.String())
+
+		src := w.Body.String()[len(`<base href="/strix/"><script src="`) : len(w.Body.String())-len(`"></script>`)]
+		w = get(t, h, "/strix/"+src)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `console.log("strix")`, w.Body.String())
+		assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+		etag := w.Header().Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		// Asset without current hash must be revalidated
+		w = get(t, h, "/strix/js/bundle.js?v=0123456789abcdef")
+		assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+		w = get(t, h, "/strix/js/bundle.js", "If-None-Match", etag)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		assert.Equal(t, http.StatusMovedPermanently, get(t, h, "/strix").Code)
+		assert.Equal(t, http.StatusNotFound, get(t, h, "/js/bundle.js").Code)
+		assert.Equal(t, http.StatusNotFound, get(t, h, "/strix/js").Code)
+		assert.Equal(t, http.StatusNotFound, get(t, h, "/strix/../strix/nothing.js").Code)
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		h, err := main.NewWebHandler(files, "/", false)
+		require.NoError(t, err)
+
+		w := get(t, h, "/")
+		assert.Equal(t, `<base href="/"><script src="js/bundle.js"></script>`, w.Body.String())
+		w = get(t, h, "/js/bundle.js")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("embedded files", func(t *testing.T) {
+		require.NoError(t, main.NewEmbeddedWebUI("/"))
+	})
+}
+
+func TestBasePath(t *testing.T) {
+	for in, out := range map[string]string{
+		"":          "/",
+		"/":         "/",
+		"strix":     "/strix/",
+		"/strix/":   "/strix/",
+		"/a//b/":    "/a/b/",
+		"/strix/..": "/",
+	} {
+		p, err := main.NormalizeBasePath(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, out, p, in)
+	}
+	_, err := main.NormalizeBasePath("https://example.com/strix")
+	assert.Error(t, err)
+
+	u, err := main.WithBasePath("https://example.com/auth/google/callback", "/strix/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/strix/auth/google/callback", u)
+
+	u, err = main.WithBasePath("https://example.com/strix/auth/google/callback", "/strix/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/strix/auth/google/callback", u)
+}
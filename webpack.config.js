@@ -8,7 +8,7 @@ module.exports = {
   output: {
     filename: "bundle.js",
     path: path.join(__dirname, "static/js/"),
-    publicPath: "/js"
+    publicPath: "js/"
   },
   module: {
     rules: [
@@ -40,7 +40,7 @@ module.exports = {
     }
   },
   devServer: {
-    contentBase: "static",
+    // index.html is rendered by strix with base path
     proxy: {
       "/auth": "http://localhost:9080",
       "/api": "http://localhost:9080",